@@ -0,0 +1,199 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/json"
+  "errors"
+  "net"
+  "net/http"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 管理接口，由admin.addr配置监听地址，所有请求都要带上Authorization: Bearer <admin.token>，
+// GET /status：当前的任务和进度、规则版本和Chrome版本，
+// POST /pause、/resume：暂停和恢复取任务（正在处理的任务不受影响），
+// POST /reload：重新加载规则，
+// POST /poll：立即取任务，不等待polling_interval，
+// POST /crawl?url=<url>：抓取一个链接并返回结果（不提交，也不保存）
+var (
+  // 暂停取任务
+  paused int32
+
+  // Browser.getVersion返回的Chrome版本
+  chromeVersion string
+
+  // 正在处理的任务
+  progress = &taskProgress{}
+
+  errAdminToken = errors.New("admin.token is required")
+)
+
+type taskProgress struct {
+  mu     sync.Mutex
+  jobID  string
+  taskID string
+  total  int
+  start  time.Time
+
+  // 抓到的数量和抓取的次数（包括重试）
+  crawled  int32
+  attempts int32
+}
+
+func (p *taskProgress) begin(j *queueJob, t *Task) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.jobID, p.taskID, p.total, p.start = j.id, t.ID, len(t.Payloads), times.Now()
+  atomic.StoreInt32(&p.crawled, 0)
+  atomic.StoreInt32(&p.attempts, 0)
+}
+
+func (p *taskProgress) end() {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.jobID, p.taskID, p.total = "", "", 0
+}
+
+func (p *taskProgress) crawl(ok bool) {
+  atomic.AddInt32(&p.attempts, 1)
+  if ok {
+    atomic.AddInt32(&p.crawled, 1)
+  }
+}
+
+type adminStatus struct {
+  Version  string            `json:"version"`
+  Paused   bool              `json:"paused"`
+  Stopping bool              `json:"stopping"`
+  Job      *adminJob         `json:"job,omitempty"`
+  Rules    map[string]string `json:"rules"`
+  Chrome   string            `json:"chrome,omitempty"`
+  Tabs     int               `json:"tabs"`
+  TabsBusy int               `json:"tabs_busy"`
+}
+
+type adminJob struct {
+  JobID    string    `json:"job_id"`
+  TaskID   string    `json:"task_id"`
+  Total    int       `json:"total"`
+  Crawled  int32     `json:"crawled"`
+  Attempts int32     `json:"attempts"`
+  Start    time.Time `json:"start"`
+}
+
+func status() *adminStatus {
+  ret := &adminStatus{
+    Version:  Version,
+    Paused:   atomic.LoadInt32(&paused) == 1,
+    Stopping: stopping(),
+    Rules:    make(map[string]string, 16),
+    Chrome:   chromeVersion,
+  }
+  for _, r := range currentRules() {
+    ret.Rules[r.Name] = r.Version
+  }
+  if tabs != nil {
+    ret.Tabs, ret.TabsBusy = tabs.size(), tabs.inUse()
+  }
+  p := progress
+  p.mu.Lock()
+  if p.jobID != "" {
+    ret.Job = &adminJob{
+      JobID:    p.jobID,
+      TaskID:   p.taskID,
+      Total:    p.total,
+      Crawled:  atomic.LoadInt32(&p.crawled),
+      Attempts: atomic.LoadInt32(&p.attempts),
+      Start:    p.start,
+    }
+  }
+  p.mu.Unlock()
+  return ret
+}
+
+func adminHandler(token string) http.Handler {
+  mux := http.NewServeMux()
+  post := func(path string, f func(w http.ResponseWriter, r *http.Request)) {
+    mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+      if r.Method != http.MethodPost {
+        writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+        return
+      }
+      f(w, r)
+    })
+  }
+  mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+    writeJSON(w, http.StatusOK, status())
+  })
+  post("/pause", func(w http.ResponseWriter, r *http.Request) {
+    atomic.StoreInt32(&paused, 1)
+    logger.Info().Msg("admin, pause")
+    writeJSON(w, http.StatusOK, status())
+  })
+  post("/resume", func(w http.ResponseWriter, r *http.Request) {
+    atomic.StoreInt32(&paused, 0)
+    logger.Info().Msg("admin, resume")
+    poll()
+    writeJSON(w, http.StatusOK, status())
+  })
+  post("/reload", func(w http.ResponseWriter, r *http.Request) {
+    logger.Info().Msg("admin, reload rules")
+    if e := reloadRules(); e != nil {
+      writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": e.Error()})
+      return
+    }
+    writeJSON(w, http.StatusOK, status())
+  })
+  post("/poll", func(w http.ResponseWriter, r *http.Request) {
+    logger.Info().Msg("admin, poll")
+    poll()
+    writeJSON(w, http.StatusAccepted, status())
+  })
+  post("/crawl", func(w http.ResponseWriter, r *http.Request) {
+    addr := strings.TrimSpace(r.FormValue("url"))
+    if addr == "" {
+      writeJSON(w, http.StatusBadRequest, map[string]string{"error": "missing url"})
+      return
+    }
+    if stopping() {
+      writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "shutting down"})
+      return
+    }
+    logger.Info().Msgf("admin, crawl %s", addr)
+    writeJSON(w, http.StatusOK, crawlWith(newURLResult(currentRules(), addr)).report())
+  })
+  expect := []byte("Bearer " + token)
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expect) != 1 {
+      writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+      return
+    }
+    mux.ServeHTTP(w, r)
+  })
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(code)
+  json.NewEncoder(w).Encode(v)
+}
+
+// 启动管理接口，返回实际监听的地址，没有配置token时不启动
+func serveAdmin(addr, token string) (string, error) {
+  if token == "" {
+    return "", errAdminToken
+  }
+  l, e := net.Listen("tcp", addr)
+  if e != nil {
+    return "", e
+  }
+  // crawl可能要等待较长时间（标签页都在使用时要排队）
+  srv := &http.Server{Handler: adminHandler(token), ReadTimeout: time.Second * 10}
+  go srv.Serve(l)
+  return l.Addr().String(), nil
+}
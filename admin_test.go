@@ -0,0 +1,107 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync/atomic"
+  "testing"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token string) (int, map[string]interface{}) {
+  t.Helper()
+  r := httptest.NewRequest(method, path, nil)
+  if token != "" {
+    r.Header.Set("Authorization", "Bearer "+token)
+  }
+  w := httptest.NewRecorder()
+  h.ServeHTTP(w, r)
+  ret := make(map[string]interface{}, 8)
+  data, _ := ioutil.ReadAll(w.Body)
+  if e := json.Unmarshal(data, &ret); e != nil {
+    t.Fatalf("invalid response %s", data)
+  }
+  return w.Code, ret
+}
+
+func TestAdmin(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  fc.Evaluate = shopEvaluate
+  h := adminHandler("secret")
+
+  if code, _ := adminRequest(t, h, "GET", "/status", ""); code != http.StatusUnauthorized {
+    t.Errorf("expect 401 without token, got %d", code)
+  }
+  if code, _ := adminRequest(t, h, "GET", "/status", "wrong"); code != http.StatusUnauthorized {
+    t.Errorf("expect 401 with wrong token, got %d", code)
+  }
+  code, ret := adminRequest(t, h, "GET", "/status", "secret")
+  rules, _ := ret["rules"].(map[string]interface{})
+  if code != http.StatusOK || ret["version"] != Version || len(rules) != 1 || len(rules["shop"].(string)) != 8 {
+    t.Errorf("unexpected status %d %v", code, ret)
+  }
+  if code, _ := adminRequest(t, h, "GET", "/pause", "secret"); code != http.StatusMethodNotAllowed {
+    t.Errorf("expect 405, got %d", code)
+  }
+
+  // 暂停后不取任务，恢复后立即取任务
+  ioutil.WriteFile(conf.Reserve, []byte(`{"id":"t1","payloads":[{"product":{"id":"31","url":"https://www.shop.test/item?id=31"}}]}`+"\n"), 0644)
+  if _, ret = adminRequest(t, h, "POST", "/pause", "secret"); ret["paused"] != true {
+    t.Errorf("expect paused, got %v", ret)
+  }
+  processTasks()
+  if fc.count("PRICE(31)") != 0 {
+    t.Error("expect no task processed while paused")
+  }
+  adminRequest(t, h, "POST", "/resume", "secret")
+  select {
+  case <-loopChan:
+  default:
+    t.Error("expect poll after resume")
+  }
+  if atomic.LoadInt32(&paused) != 0 {
+    t.Error("expect resumed")
+  }
+  processTasks()
+  if fc.count("PRICE(31)") != 1 {
+    t.Error("expect task processed after resume")
+  }
+
+  code, ret = adminRequest(t, h, "POST", "/crawl?url="+"https://m.shop.test/detail?id=5", "secret")
+  p, _ := ret["product"].(map[string]interface{})
+  if code != http.StatusOK || ret["status"] != statusOK || p["id"] != "5" || p["price"] != float64(5) {
+    t.Errorf("unexpected crawl %d %v", code, ret)
+  }
+  if code, _ = adminRequest(t, h, "POST", "/crawl", "secret"); code != http.StatusBadRequest {
+    t.Errorf("expect 400 without url, got %d", code)
+  }
+}
+
+func TestAdminStatusProgress(t *testing.T) {
+  progress.begin(&queueJob{id: "9"}, &Task{ID: "t9", Payloads: make([]*Payload, 3)})
+  defer progress.end()
+  progress.crawl(false)
+  progress.crawl(true)
+  s := status()
+  if s.Job == nil || s.Job.JobID != "9" || s.Job.TaskID != "t9" || s.Job.Total != 3 || s.Job.Crawled != 1 || s.Job.Attempts != 2 {
+    t.Errorf("unexpected job %+v", s.Job)
+  }
+  data, _ := json.Marshal(s)
+  if !strings.Contains(string(data), `"task_id":"t9"`) {
+    t.Errorf("unexpected status %s", data)
+  }
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+  "encoding/json"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "strings"
+
+  "github.com/rs/zerolog"
+)
+
+// 子命令，用法：hiprice-runner <command> [flags] [args]，
+// 不带子命令（或只带配置文件路径）时作为Runner运行
+var commands = map[string]func(args []string) int{
+  "validate":  cmdValidate,
+  "capture":   cmdCapture,
+  "crawl":     cmdCrawl,
+  "normalize": cmdNormalize,
+  "dump":      cmdDump,
+  "get":       cmdGet,
+  "import":    cmdImport,
+  "compact":   cmdCompact,
+  "replay":    cmdReplay,
+}
+
+func newFlagSet(name, usage string) (*flag.FlagSet, *string) {
+  fs := flag.NewFlagSet(name, flag.ContinueOnError)
+  conf := fs.String("conf", "conf.yaml", "config file")
+  fs.Usage = func() {
+    fmt.Fprintf(fs.Output(), "usage: hiprice-runner %s [flags] %s\n", name, usage)
+    fs.PrintDefaults()
+  }
+  return fs, conf
+}
+
+// 检查规则，输出所有的错误和警告，有错误时返回1，
+// 默认检查task.rules目录，也可以指定目录
+func cmdValidate(args []string) int {
+  fs, conf := newFlagSet("validate", "[dir]")
+  if fs.Parse(args) != nil {
+    return 2
+  }
+  dir := fs.Arg(0)
+  if dir == "" {
+    if e := LoadConf(*conf); e != nil {
+      fmt.Fprintln(os.Stderr, e)
+      return 1
+    }
+    dir = Conf.Task.Rules
+  }
+  rules, problems := loadRules(dir)
+  errs, warns := 0, 0
+  for _, p := range problems {
+    if p.Warn {
+      warns++
+    } else {
+      errs++
+    }
+    fmt.Println(p)
+  }
+  fmt.Printf("%d rule(s) ok, %d error(s), %d warning(s)\n", len(rules), errs, warns)
+  if errs > 0 {
+    return 1
+  }
+  return 0
+}
+
+// 子命令的初始化：加载配置和规则，日志输出到stderr，
+// 不连接任务队列，也不打开store
+func initCommand(conf string, withChrome bool) error {
+  e := LoadConf(conf)
+  if e != nil {
+    return e
+  }
+  e = LoadRules(Conf.Task.Rules)
+  if e != nil {
+    return e
+  }
+  lg := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.WarnLevel).With().Timestamp().Logger()
+  logger = &lg
+  if withChrome {
+    initChrome()
+  }
+  return nil
+}
+
+// 抓取线上页面并保存为fixture（页面快照和抓到的字段），
+// 用例名默认为商品ID，保存后需要人工核对json中的期望值
+func cmdCapture(args []string) int {
+  fs, conf := newFlagSet("capture", "<url>")
+  name := fs.String("name", "", "fixture name (default product id)")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  if e := initCommand(*conf, true); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer closeChrome()
+  addr, rule, _ := normalizeURL(currentRules(), fs.Arg(0))
+  if rule == nil {
+    fmt.Fprintf(os.Stderr, "no rule matches %s\n", fs.Arg(0))
+    return 1
+  }
+  tab, e := tabs.get()
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  r := newCrawlResult(addr)
+  var page string
+  ok := navigate(tab, addr)
+  if ok {
+    ok = extract(tab, addr, rule, r)
+  }
+  if ok {
+    page, ok = evaluate(tab, snapshotExpression)
+  }
+  tabs.put(tab, !ok)
+  p := r.Product
+  if !ok || p.ID == "" || page == "" {
+    fmt.Fprintf(os.Stderr, "crawl %s failed, %s\n", addr, r)
+    return 1
+  }
+  if *name == "" {
+    *name = p.ID
+  }
+  file, e := saveFixture(Conf.Task.Rules, rule.Name, *name, page, p)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  data, _ := json.MarshalIndent(p, "", "  ")
+  fmt.Println(string(data))
+  fmt.Printf("saved %s, check the expected values before committing\n", file)
+  return 0
+}
+
+// 抓取一个链接，输出标准URL、每个脚本的结果和耗时以及抓到的商品，
+// 用于调试规则，不连接任务队列，也不保存
+func cmdCrawl(args []string) int {
+  fs, conf := newFlagSet("crawl", "<url>")
+  asJSON := fs.Bool("json", false, "print the result as json")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  if e := initCommand(*conf, true); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer closeChrome()
+  r := traceCrawl(currentRules(), fs.Arg(0))
+  printCrawl(os.Stdout, r, *asJSON)
+  if !r.ok() {
+    return 1
+  }
+  return 0
+}
+
+func traceCrawl(rs ruleSet, addr string) *crawlResult {
+  r, rule := newURLResult(rs, addr)
+  r.Scripts = make([]*scriptTrace, 0, 8)
+  return crawlWith(r, rule)
+}
+
+func printCrawl(w io.Writer, r *crawlResult, asJSON bool) {
+  report := r.report()
+  if asJSON {
+    data, _ := json.MarshalIndent(report, "", "  ")
+    fmt.Fprintln(w, string(data))
+    return
+  }
+  fmt.Fprintf(w, "url:     %s\n", report.URL)
+  if r.Field != "" {
+    fmt.Fprintf(w, "status:  %s (%s)\n", report.Status, r.Field)
+  } else {
+    fmt.Fprintf(w, "status:  %s\n", report.Status)
+  }
+  fmt.Fprintf(w, "load:    %v\nelapsed: %v\n", r.Load, r.Elapsed)
+  if len(r.Missing) > 0 {
+    fmt.Fprintf(w, "missing: %s\n", strings.Join(r.Missing, ", "))
+  }
+  for _, v := range r.Scripts {
+    if v.Async {
+      fmt.Fprintf(w, "  %-10s %5dms (async)\n", v.Name, v.Elapsed)
+      continue
+    }
+    fmt.Fprintf(w, "  %-10s %5dms raw=%q value=%q\n", v.Name, v.Elapsed, v.Raw, v.Value)
+  }
+  if report.Product != nil {
+    data, _ := json.MarshalIndent(report.Product, "", "  ")
+    fmt.Fprintln(w, string(data))
+  }
+}
+
+// 输出链接匹配到的规则和chain，以及转换（或打开页面跳转后）得到的标准URL
+func cmdNormalize(args []string) int {
+  fs, conf := newFlagSet("normalize", "<url>")
+  asJSON := fs.Bool("json", false, "print the result as json")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  if e := initCommand(*conf, false); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  // 只有需要打开页面时才启动Chrome
+  if !normalizesDirectly(currentRules(), fs.Arg(0)) {
+    initChrome()
+    defer closeChrome()
+  }
+  tr := &normalizeTrace{}
+  normalize(currentRules(), fs.Arg(0), tr)
+  printNormalize(os.Stdout, tr, *asJSON)
+  if tr.FinalRule == "" {
+    return 1
+  }
+  return 0
+}
+
+func printNormalize(w io.Writer, tr *normalizeTrace, asJSON bool) {
+  if asJSON {
+    data, _ := json.MarshalIndent(tr, "", "  ")
+    fmt.Fprintln(w, string(data))
+    return
+  }
+  name := func(rule string, chain int) string {
+    if rule == "" {
+      return "(none)"
+    }
+    if chain < 0 {
+      return rule + ", no chain"
+    }
+    return fmt.Sprintf("%s, chain[%d]", rule, chain)
+  }
+  fmt.Fprintf(w, "input:    %s\n", tr.Input)
+  fmt.Fprintf(w, "match:    %s\n", name(tr.Rule, tr.Chain))
+  if tr.Direct != "" {
+    fmt.Fprintf(w, "chain:    %s\n", tr.Direct)
+  }
+  if tr.Evaluated {
+    fmt.Fprintf(w, "document: %s\n", tr.DocumentURL)
+    if tr.ScriptURL != "" {
+      fmt.Fprintf(w, "script:   %s\n", tr.ScriptURL)
+    }
+    fmt.Fprintf(w, "final:    %s\n", name(tr.FinalRule, tr.FinalChain))
+  }
+  fmt.Fprintf(w, "output:   %s\n", tr.Output)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+  "bufio"
+  "encoding/json"
+  "fmt"
+  "io"
+  "os"
+  "time"
+
+  "github.com/rs/zerolog"
+  "go.etcd.io/bbolt"
+)
+
+// store相关子命令的初始化：加载配置，打开store.path（Runner正在运行时会失败）
+func initStoreCommand(conf string) error {
+  e := LoadConf(conf)
+  if e != nil {
+    return e
+  }
+  lg := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).Level(zerolog.WarnLevel).With().Timestamp().Logger()
+  logger = &lg
+  if Conf.Store.Path == "" {
+    Conf.Store.Path = "runner.db"
+  }
+  store, e = openStore(Conf.Store.Path, time.Second)
+  return e
+}
+
+// 导出所有商品（每行一个JSON），默认输出到stdout
+func cmdDump(args []string) int {
+  fs, conf := newFlagSet("dump", "[file]")
+  if fs.Parse(args) != nil {
+    return 2
+  }
+  if e := initStoreCommand(*conf); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer store.Close()
+  var w io.Writer = os.Stdout
+  if fs.NArg() > 0 {
+    f, e := os.Create(fs.Arg(0))
+    if e != nil {
+      fmt.Fprintln(os.Stderr, e)
+      return 1
+    }
+    defer f.Close()
+    w = f
+  }
+  bw := bufio.NewWriter(w)
+  count := 0
+  e := store.EachKV(bucketProducts, func(k, v []byte, n int) error {
+    count++
+    bw.Write(v)
+    return bw.WriteByte('\n')
+  })
+  if e == nil {
+    e = bw.Flush()
+  }
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  fmt.Fprintf(os.Stderr, "%d product(s) dumped\n", count)
+  return 0
+}
+
+// 查询一个商品和它的价格历史
+func cmdGet(args []string) int {
+  fs, conf := newFlagSet("get", "<id>")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  if e := initStoreCommand(*conf); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer store.Close()
+  id := fs.Arg(0)
+  data := store.Get(bucketProducts, []byte(id))
+  if data == nil {
+    fmt.Fprintf(os.Stderr, "product %s not found\n", id)
+    return 1
+  }
+  p := &Product{}
+  json.Unmarshal(data, p)
+  data, _ = json.MarshalIndent(p, "", "  ")
+  fmt.Println(string(data))
+  for _, v := range productHistory(id, time.Time{}) {
+    if v.Price == RangePrice {
+      fmt.Printf("%s price=[%.2f, %.2f], stock=%d, sales=%d\n", v.Time.Format(time.RFC3339), v.PriceLow, v.PriceHigh, v.Stock, v.Sales)
+    } else {
+      fmt.Printf("%s price=%.2f, stock=%d, sales=%d\n", v.Time.Format(time.RFC3339), v.Price, v.Stock, v.Sales)
+    }
+  }
+  return 0
+}
+
+// 导入dump导出的商品（用于新的Runner继承去重的状态），
+// 已经存在并且抓取时间更晚的商品不会被覆盖
+func cmdImport(args []string) int {
+  fs, conf := newFlagSet("import", "<file>")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  if e := initStoreCommand(*conf); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer store.Close()
+  var r io.Reader = os.Stdin
+  if fs.Arg(0) != "-" {
+    f, e := os.Open(fs.Arg(0))
+    if e != nil {
+      fmt.Fprintln(os.Stderr, e)
+      return 1
+    }
+    defer f.Close()
+    r = f
+  }
+  imported, skipped, e := importProducts(r)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  fmt.Fprintf(os.Stderr, "%d product(s) imported, %d skipped\n", imported, skipped)
+  return 0
+}
+
+// 每个事务最多导入（或压缩时复制）的数量
+const storeBatch = 1000
+
+func importProducts(r io.Reader) (int, int, error) {
+  imported, skipped, line := 0, 0, 0
+  batch := make([]*Product, 0, storeBatch)
+  flush := func() error {
+    e := store.UpdateB(bucketProducts, func(b *bbolt.Bucket) error {
+      for _, p := range batch {
+        if v := b.Get([]byte(p.key())); v != nil {
+          old := &Product{}
+          if json.Unmarshal(v, old) == nil && !old.UpdateTime.Before(p.UpdateTime) {
+            skipped++
+            continue
+          }
+        }
+        data, _ := json.Marshal(p)
+        if e := b.Put([]byte(p.key()), data); e != nil {
+          return e
+        }
+        imported++
+      }
+      return nil
+    })
+    batch = batch[:0]
+    return e
+  }
+  scanner := bufio.NewScanner(r)
+  scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+  for scanner.Scan() {
+    line++
+    data := scanner.Bytes()
+    if len(data) == 0 {
+      continue
+    }
+    p := &Product{}
+    if e := json.Unmarshal(data, p); e != nil || p.ID == "" {
+      return imported, skipped, fmt.Errorf("line %d: invalid product", line)
+    }
+    batch = append(batch, p)
+    if len(batch) == storeBatch {
+      if e := flush(); e != nil {
+        return imported, skipped, e
+      }
+    }
+  }
+  if e := scanner.Err(); e != nil {
+    return imported, skipped, e
+  }
+  return imported, skipped, flush()
+}
+
+// 压缩store（删除数据后文件不会变小），先写入临时文件，完成后替换原文件
+func cmdCompact(args []string) int {
+  fs, conf := newFlagSet("compact", "")
+  if fs.Parse(args) != nil {
+    return 2
+  }
+  if e := initStoreCommand(*conf); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  path := Conf.Store.Path
+  tmp := path + ".compact"
+  os.Remove(tmp)
+  dst, e := bbolt.Open(tmp, 0644, nil)
+  if e == nil {
+    e = compactStore(dst, store.DB, storeBatch)
+    if e2 := dst.Close(); e == nil {
+      e = e2
+    }
+  }
+  store.Close()
+  if e != nil {
+    os.Remove(tmp)
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  before, _ := os.Stat(path)
+  after, _ := os.Stat(tmp)
+  e = os.Rename(tmp, path)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  fmt.Fprintf(os.Stderr, "compact %s, %d -> %d bytes\n", path, before.Size(), after.Size())
+  return 0
+}
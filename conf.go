@@ -9,13 +9,50 @@ import (
 var Conf = &struct {
   Log       LogConf       `yaml:"log"`
   Beanstalk BeanstalkConf `yaml:"beanstalk"`
+  Queue     QueueConf     `yaml:"queue"`
   Chrome    ChromeConf    `yaml:"chrome"`
   Task      TaskConf      `yaml:"task"`
+  Store     StoreConf     `yaml:"store"`
+  Metrics   MetricsConf   `yaml:"metrics"`
+  Admin     AdminConf     `yaml:"admin"`
 }{}
 
 type LogConf struct {
   Dir   string `yaml:"dir"`
   Level string `yaml:"level"`
+
+  // file（默认）或stdout
+  Output string `yaml:"output"`
+
+  // json（默认）或console
+  Format string `yaml:"format"`
+
+  // 单个日志文件的最大大小（MB），超过后切分，0表示只按天切分
+  MaxSize int `yaml:"max_size"`
+
+  // 保留的日志文件数，0表示全部保留
+  Keep int `yaml:"keep"`
+
+  // 切分后用gzip压缩
+  Gzip bool `yaml:"gzip"`
+
+  Dump DumpConf `yaml:"dump"`
+}
+
+// 取到的任务和提交的报告的dump（log.dir/dump/<日期>/）
+type DumpConf struct {
+  // 不dump
+  Disable bool `yaml:"disable"`
+
+  // 每sample个任务dump一个（按任务ID取样），0和1表示全部dump
+  Sample int `yaml:"sample"`
+
+  // 用gzip压缩（.json.gz）
+  Gzip bool `yaml:"gzip"`
+
+  // 保留的天数和总大小（MB），0表示不限制
+  MaxAge  int `yaml:"max_age"`
+  MaxSize int `yaml:"max_size"`
 }
 
 type BeanstalkConf struct {
@@ -28,11 +65,57 @@ type BeanstalkConf struct {
   PutDelay       int    `yaml:"put_delay"`
   PutTTR         int    `yaml:"put_ttr"`
   Heartbeat      int    `yaml:"heartbeat"`
+
+  // 提交发现的新商品的tube，优先级、延迟和TTR与put的相同
+  DiscoverTube string `yaml:"discover_tube"`
+}
+
+// 任务队列，Type为beanstalk（默认，使用beanstalk的配置）、redis或file
+type QueueConf struct {
+  Type string `yaml:"type"`
+
+  // 处理任务期间touch的间隔（秒），要小于任务的TTR，0表示不touch
+  TouchInterval int `yaml:"touch_interval"`
+
+  // 任务处理失败后放回队列的延迟（秒）
+  ReleaseDelay int `yaml:"release_delay"`
+
+  // 任务最多处理几次，超过后bury，0表示不限制
+  MaxAttempts int `yaml:"max_attempts"`
+
+  Redis RedisConf     `yaml:"redis"`
+  File  FileQueueConf `yaml:"file"`
+}
+
+type RedisConf struct {
+  Addr           string `yaml:"addr"`
+  Password       string `yaml:"password"`
+  DB             int    `yaml:"db"`
+  ReserveStream  string `yaml:"reserve_stream"`
+  PutStream      string `yaml:"put_stream"`
+  BuriedStream   string `yaml:"buried_stream"`
+  DiscoverStream string `yaml:"discover_stream"`
+  Group          string `yaml:"group"`
+  Consumer       string `yaml:"consumer"`
+
+  // 取任务的超时时间（秒），0表示不等待
+  ReserveTimeout int `yaml:"reserve_timeout"`
+
+  // 任务超过该时间（秒）没有touch，就可以被其他Runner取走
+  TTR int `yaml:"ttr"`
+}
+
+type FileQueueConf struct {
+  Reserve  string `yaml:"reserve"`
+  Put      string `yaml:"put"`
+  Buried   string `yaml:"buried"`
+  Discover string `yaml:"discover"`
 }
 
 type ChromeConf struct {
   Windows Chrome `yaml:"windows"`
   Linux   Chrome `yaml:"linux"`
+  Tabs    int    `yaml:"tabs"`
 }
 
 type Chrome struct {
@@ -41,11 +124,68 @@ type Chrome struct {
 }
 
 type TaskConf struct {
-  PollingInterval int    `yaml:"polling_interval"`
-  Rules           string `yaml:"rules"`
-  CrawlDuration   int    `yaml:"crawl_duration"`
-  CrawlRetry      int    `yaml:"crawl_retry"`
-  CrawlTimeout    int    `yaml:"crawl_timeout"`
+  PollingInterval int            `yaml:"polling_interval"`
+  Rules           string         `yaml:"rules"`
+  RulesWatch      int            `yaml:"rules_watch"`
+  CrawlDuration   int            `yaml:"crawl_duration"`
+  CrawlRetry      int            `yaml:"crawl_retry"`
+  CrawlTimeout    int            `yaml:"crawl_timeout"`
+  ShutdownTimeout int            `yaml:"shutdown_timeout"`
+  Politeness      PolitenessConf `yaml:"politeness"`
+  Discover        DiscoverConf   `yaml:"discover"`
+}
+
+// 从抓到的商品中发现新商品（规则中的discover），提交到发现队列
+type DiscoverConf struct {
+  // 每个任务最多提交的新商品数，0表示不发现
+  Budget int `yaml:"budget"`
+
+  // 每个任务最多检查的链接数（包括不支持的），0表示budget的10倍
+  Candidates int `yaml:"candidates"`
+}
+
+// 对同一个站点的抓取限制，
+// 在task中配置的是默认值，规则中也可以配置（只覆盖规则中配置了的字段）
+type PolitenessConf struct {
+  // 两次请求之间的最小间隔（毫秒）
+  Interval int `yaml:"interval"`
+
+  // 每次请求在最小间隔的基础上再随机增加[0,Jitter)毫秒
+  Jitter int `yaml:"jitter"`
+
+  // 同时抓取的最大数量，0表示不限制（但总数不会超过chrome.tabs）
+  Concurrency int `yaml:"concurrency"`
+}
+
+// 本地的store
+type StoreConf struct {
+  // 文件路径，默认为runner.db
+  Path string `yaml:"path"`
+
+  // 超过该天数没有抓过的商品（包括价格历史）会被删除，0表示不删除
+  TTL int `yaml:"ttl"`
+
+  // 检查并删除过期商品的间隔（分钟）
+  EvictInterval int `yaml:"evict_interval"`
+
+  // 价格历史保留的天数，0表示不保存历史
+  History int `yaml:"history"`
+
+  // 报告中的最低价统计的天数，0表示不统计
+  Lowest int `yaml:"lowest"`
+}
+
+type MetricsConf struct {
+  // Prometheus指标的监听地址（如:9100），为空时不监听
+  Addr string `yaml:"addr"`
+}
+
+type AdminConf struct {
+  // 管理接口的监听地址（如127.0.0.1:9101），为空时不监听
+  Addr string `yaml:"addr"`
+
+  // 请求时需要带上Authorization: Bearer <token>，为空时不启动管理接口
+  Token string `yaml:"token"`
 }
 
 func LoadConf(file string) error {
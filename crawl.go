@@ -4,13 +4,12 @@ import (
   "encoding/json"
   "encoding/xml"
   "html"
-  "strconv"
+  "net/url"
   "strings"
   "time"
   "unicode"
 
   "github.com/kwf2030/commons/cdp"
-  "github.com/kwf2030/commons/conv"
 )
 
 const space = rune(' ')
@@ -24,20 +23,30 @@ type msgXml struct {
   } `xml:"appmsg"`
 }
 
-func crawlMessage(m *Message) *Product {
+// rs是开始抓取时的规则快照，整个抓取过程都使用同一个快照（抓取过程中规则可能会被重新加载）
+func crawlMessage(rs ruleSet, m *Message) *crawlResult {
   logger.Debug().Msgf("crawl message %s", m.ID)
+  addr := messageURL(m)
+  if addr == "" {
+    return newCrawlResult("").fail(failNoURL, "")
+  }
+  return crawlWith(newURLResult(rs, addr))
+}
+
+// 从消息中提取链接，提取不到返回空字符串
+func messageURL(m *Message) string {
   if m.URL != "" {
-    return doCrawl(normalizeURL(html.UnescapeString(m.URL)))
+    return html.UnescapeString(m.URL)
   }
   if m.Content == "" {
-    return nil
+    return ""
   }
   var addr string
   if len(m.Content) >= 7 && m.Content[:7] == "&lt;msg" {
     v := &msgXml{}
     e := xml.Unmarshal([]byte(html.UnescapeString(m.Content)), v)
     if e != nil {
-      return nil
+      return ""
     }
     if v.AppMsg.URL != "" {
       addr = html.UnescapeString(v.AppMsg.URL)
@@ -50,18 +59,19 @@ func crawlMessage(m *Message) *Product {
   } else {
     addr = findURLFromText(html.UnescapeString(m.Content))
   }
-  if addr == "" {
-    return nil
-  }
-  return doCrawl(normalizeURL(addr))
+  return addr
 }
 
-func crawlProduct(p *Product) *Product {
+func crawlProduct(rs ruleSet, p *Product) *crawlResult {
   logger.Debug().Msgf("crawl product %s", p.ID)
   if p.URL == "" {
-    return nil
+    return newCrawlResult("").fail(failNoURL, "")
+  }
+  r := crawlWith(newURLResult(rs, html.UnescapeString(p.URL)))
+  if r.ok() && p.ID != "" && r.Product.ID != p.ID {
+    r.fail(failIDMismatch, "id")
   }
-  return doCrawl(normalizeURL(html.UnescapeString(p.URL)))
+  return r
 }
 
 func findURLFromText(text string) string {
@@ -82,8 +92,8 @@ func findURLFromText(text string) string {
   return text[l:h]
 }
 
-func findRuleByURL(addr string) *rule {
-  for _, r := range Rules {
+func (rs ruleSet) findRuleByURL(addr string) *rule {
+  for _, r := range rs {
     for i := range r.Match {
       if r.MatchRegex[i].MatchString(addr) {
         return r
@@ -93,8 +103,17 @@ func findRuleByURL(addr string) *rule {
   return nil
 }
 
-func findChainByURL(addr string) (*rule, *chain) {
-  rule := findRuleByURL(addr)
+func (rs ruleSet) findRuleBySource(source int) *rule {
+  for _, r := range rs {
+    if r.Source == source {
+      return r
+    }
+  }
+  return nil
+}
+
+func (rs ruleSet) findChainByURL(addr string) (*rule, *chain) {
+  rule := rs.findRuleByURL(addr)
   if rule == nil {
     return nil, nil
   }
@@ -121,20 +140,69 @@ func matchURLFromChain(addr string, chain *chain) string {
   return ""
 }
 
-func normalizeURL(addr string) (string, *rule, *chain) {
-  rule, chain := findChainByURL(addr)
+// 不打开页面就能转换为标准URL（匹配到规则，并且没有匹配到chain或chain能直接转换）
+func normalizesDirectly(rs ruleSet, addr string) bool {
+  rule, chain := rs.findChainByURL(addr)
+  return rule != nil && (chain == nil || matchURLFromChain(addr, chain) != "")
+}
+
+func normalizeURL(rs ruleSet, addr string) (string, *rule, *chain) {
+  return normalize(rs, addr, nil)
+}
+
+// normalizeURL的每一步，用于调试规则（normalize命令）
+type normalizeTrace struct {
+  Input string `json:"input"`
+
+  // 直接匹配到的规则和chain（chain在规则中的下标，-1表示没有匹配到），以及chain转换的结果
+  Rule   string `json:"rule,omitempty"`
+  Chain  int    `json:"chain"`
+  Direct string `json:"direct,omitempty"`
+
+  // 不能直接转换时打开页面，得到document.URL和chain表达式计算的结果
+  Evaluated   bool   `json:"evaluated"`
+  DocumentURL string `json:"document_url,omitempty"`
+  ScriptURL   string `json:"script_url,omitempty"`
+
+  // 最终的规则、chain和标准URL
+  FinalRule  string `json:"final_rule,omitempty"`
+  FinalChain int    `json:"final_chain"`
+  Output     string `json:"output"`
+}
+
+// tr不为nil时记录每一步的结果
+func normalize(rs ruleSet, addr string, tr *normalizeTrace) (ret string, rule *rule, chain *chain) {
+  if tr != nil {
+    tr.Input, tr.Chain = addr, -1
+    defer func() {
+      tr.Output, tr.FinalChain = ret, chainIndex(rule, chain)
+      if rule != nil {
+        tr.FinalRule = rule.Name
+      }
+    }()
+  }
+  rule, chain = rs.findChainByURL(addr)
+  if tr != nil && rule != nil {
+    tr.Rule, tr.Chain = rule.Name, chainIndex(rule, chain)
+  }
   if rule != nil {
     if chain == nil {
       return addr, rule, nil
     }
     str := matchURLFromChain(addr, chain)
+    if tr != nil {
+      tr.Direct = str
+    }
     if str != "" {
       return str, rule, chain
     }
   }
   var addr1, addr2 string
   // 返回的是document.URL和chain表达式（如果有）计算的结果（都是URL，优先使用addr1）
-  addr1, addr2, rule, chain = evalURL(addr)
+  addr1, addr2, rule, chain = evalURL(rs, addr)
+  if tr != nil {
+    tr.Evaluated, tr.DocumentURL, tr.ScriptURL = true, addr1, addr2
+  }
   if chain == nil {
     return addr1, rule, nil
   }
@@ -149,52 +217,49 @@ func normalizeURL(addr string) (string, *rule, *chain) {
   return addr, rule, nil
 }
 
-func evalURL(addr string) (string, string, *rule, *chain) {
+// chain在规则中的下标，没有时返回-1
+func chainIndex(rule *rule, chain *chain) int {
+  if rule == nil || chain == nil {
+    return -1
+  }
+  for i, c := range rule.Chain {
+    if c == chain {
+      return i
+    }
+  }
+  return -1
+}
+
+func evalURL(rs ruleSet, addr string) (string, string, *rule, *chain) {
   var addr1, addr2 string
   var rule *rule
   var chain *chain
-  done := make(chan struct{})
-  tab, _ := chrome.NewTab()
-  tab.Subscribe(cdp.Page.LoadEventFired)
-  tab.Call(cdp.Page.Enable)
-  tab.Call(cdp.Page.Navigate, cdp.Params{"url": addr})
-  go func() {
-    time.Sleep(time.Second * 2)
-    for msg := range tab.C {
-      if msg.Method != cdp.Page.LoadEventFired {
-        continue
-      }
-      params := cdp.Params{"objectGroup": "console", "includeCommandLineAPI": true}
-      params["expression"] = "document.URL"
-      v1 := tab.Call(cdp.Runtime.Evaluate, params)
-      addr1 = conv.String(conv.Map(v1.Result, "result"), "value")
-      if addr1 == "" {
-        break
-      }
-      rule, chain = findChainByURL(addr1)
-      if chain == nil {
-        break
-      }
-      if chain.Script != "" && chain.ScriptTemplate != "" {
-        params["expression"] = chain.Script
-        v2 := tab.Call(cdp.Runtime.Evaluate, params)
-        addr2 = strings.Replace(chain.ScriptTemplate, "$id", conv.String(conv.Map(v2.Result, "result"), "value"), -1)
-        if addr2 == "" {
-          break
-        }
-        rule, chain = findChainByURL(addr2)
+  tab, e := tabs.get()
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: NewTab")
+    return addr1, addr2, rule, chain
+  }
+  start := time.Now()
+  ok := navigate(tab, addr)
+  // 等待跳转（短链接等），至少2秒
+  if d := time.Second*2 - time.Since(start); ok && d > 0 {
+    time.Sleep(d)
+  }
+  if ok {
+    addr1, ok = evaluate(tab, "document.URL")
+  }
+  if ok && addr1 != "" {
+    rule, chain = rs.findChainByURL(addr1)
+    if chain != nil && chain.Script != "" && chain.ScriptTemplate != "" {
+      var v string
+      v, ok = evaluate(tab, chain.Script)
+      addr2 = strings.Replace(chain.ScriptTemplate, "$id", v, -1)
+      if addr2 != "" {
+        rule, chain = rs.findChainByURL(addr2)
       }
-      break
     }
-    close(done)
-  }()
-  select {
-  case <-time.After(time.Second * time.Duration(Conf.Task.CrawlTimeout)):
-    tab.C <- &cdp.Message{Method: cdp.Page.LoadEventFired}
-    <-done
-  case <-done:
   }
-  tab.Close()
+  tabs.put(tab, !ok)
   return addr1, addr2, rule, chain
 }
 
@@ -210,63 +275,111 @@ func matchIDFromRule(addr string, rule *rule) string {
   return ""
 }
 
-func doCrawl(addr string, rule *rule, _ *chain) *Product {
-  p := NewProduct()
-  done := make(chan struct{})
-  tab, _ := chrome.NewTab()
-  tab.Subscribe(cdp.Page.LoadEventFired)
-  tab.Call(cdp.Page.Enable)
-  tab.Call(cdp.Page.Navigate, cdp.Params{"url": addr})
-  go func() {
-    params := cdp.Params{"objectGroup": "console", "includeCommandLineAPI": true}
-    for msg := range tab.C {
-      if msg.Method != cdp.Page.LoadEventFired {
-        continue
+// 抓取标准URL（normalizeURL的结果），
+// 规则为nil表示不支持的网站，链接中匹配不到商品ID时不打开页面
+func doCrawl(addr string, rule *rule, _ *chain) *crawlResult {
+  return crawlWith(newCrawlResult(addr), rule)
+}
+
+// 抓取r.URL，结果保存在r中（r.Scripts不为nil时记录每个脚本的结果）
+func crawlWith(r *crawlResult, rule *rule) *crawlResult {
+  addr := r.URL
+  start := time.Now()
+  defer func() {
+    r.Elapsed = time.Since(start)
+    if rule != nil {
+      metricCrawlDuration.observe(r.Elapsed.Seconds(), rule.Name)
+    }
+    logger.Debug().Msgf("crawl done, %s", r)
+  }()
+  switch {
+  case addr == "":
+    // 打开短链接等跳转失败
+    return r.fail(failTab, "redirect")
+  case rule == nil:
+    return r.fail(failUnsupported, "")
+  case matchIDFromRule(addr, rule) == "":
+    return r.fail(failNoID, "")
+  }
+  tab, e := tabs.get()
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: NewTab")
+    return r.fail(failTab, "new_tab")
+  }
+  ok := navigate(tab, addr)
+  r.Load = time.Since(start)
+  if ok {
+    ok = extract(tab, addr, rule, r)
+  } else {
+    r.fail(failTab, "navigate")
+  }
+  tabs.put(tab, !ok)
+  return r
+}
+
+// 在已经打开的页面上执行规则中的脚本，结果保存在r中，
+// 返回false表示标签页已经不可用
+func extract(tab *cdp.Tab, addr string, rule *rule, r *crawlResult) bool {
+  id := matchIDFromRule(addr, rule)
+  if id == "" {
+    r.fail(failNoID, "")
+    return true
+  }
+  p := r.Product
+  p.ID = id
+  p.URL = addr
+  p.Source = rule.Source
+  p.Currency = rule.Currency
+  for _, v := range rule.Scripts {
+    expression := v.Script
+    if v.Plan != nil {
+      expression = v.Plan.expression
+    }
+    expression = strings.Replace(expression, "$id", id, -1)
+    start := time.Now()
+    if v.Async {
+      if !callAsync(tab, cdp.Runtime.Evaluate, cdp.Params{"objectGroup": "console", "includeCommandLineAPI": true, "expression": expression}) {
+        r.fail(failTab, v.Name)
+        return false
       }
-      id := matchIDFromRule(addr, rule)
-      if id == "" {
-        break
+      r.trace(v, "", "", start)
+    } else {
+      raw, ok := evaluate(tab, expression)
+      if !ok {
+        r.fail(failTab, v.Name)
+        return false
       }
-      p.ID = id
-      p.URL = addr
-      p.Source = rule.Source
-      p.Currency = rule.Currency
-      for _, v := range rule.Scripts {
-        params["expression"] = strings.Replace(v.Script, "$id", id, -1)
-        if v.Async {
-          tab.CallAsync(cdp.Runtime.Evaluate, params)
-        } else {
-          r := tab.Call(cdp.Runtime.Evaluate, params)
-          s := conv.String(conv.Map(r.Result, "result"), "value")
-          handle(rule.Source, v.Name, s, p)
-        }
-        if v.Sleep > 0 {
-          time.Sleep(time.Millisecond * time.Duration(v.Sleep))
-        }
+      s := raw
+      if v.Plan != nil {
+        s = v.Plan.apply(s)
       }
-      break
+      if v.Type != "" {
+        setAttribute(rule.Locale, v, s, p)
+      } else {
+        handle(rule.Locale, v.Name, s, p)
+      }
+      r.trace(v, raw, s, start)
     }
-    close(done)
-  }()
-  select {
-  case <-time.After(time.Second * time.Duration(Conf.Task.CrawlTimeout)):
-    logger.Debug().Msg("crawl timeout, execute expression")
-    tab.C <- &cdp.Message{Method: cdp.Page.LoadEventFired}
-    <-done
-  case <-done:
-    logger.Debug().Msg("crawl done")
-  }
-  tab.Close()
-  return p
+    if v.Sleep > 0 {
+      time.Sleep(time.Millisecond * time.Duration(v.Sleep))
+    }
+  }
+  if rule.SKU != nil && !crawlSKUs(tab, id, rule, r) {
+    return false
+  }
+  if r.ok() {
+    r.check(rule)
+  }
+  return true
 }
 
-func handle(_ int, name string, value string, p *Product) {
+func handle(l *locale, name string, value string, p *Product) {
   switch name {
   case "title":
     p.Title = value
 
   case "price":
-    arr := parsePrice(value)
+    arr := l.parsePrice(value)
     if len(arr) == 1 {
       p.Price = arr[0]
     } else if len(arr) == 2 {
@@ -276,10 +389,10 @@ func handle(_ int, name string, value string, p *Product) {
     }
 
   case "stock":
-    p.Stock = atoi(value)
+    p.Stock = l.atoi(value)
 
   case "sales":
-    p.Sales = atoi(value)
+    p.Sales = l.atoi(value)
 
   case "category":
     p.Category = value
@@ -292,86 +405,109 @@ func handle(_ int, name string, value string, p *Product) {
       break
     }
     if v, ok := m["total"]; ok && v != "" {
-      p.Comments.Total = atoi(v)
+      p.Comments.Total = l.atoi(v)
     } else {
       p.Comments.Total = NoValue
       break
     }
     if v, ok := m["star5"]; ok && v != "" {
-      p.Comments.Star5 = atoi(v)
+      p.Comments.Star5 = l.atoi(v)
     }
     if v, ok := m["star4"]; ok && v != "" {
-      p.Comments.Star4 = atoi(v)
+      p.Comments.Star4 = l.atoi(v)
     }
     if v, ok := m["star3"]; ok && v != "" {
-      p.Comments.Star3 = atoi(v)
+      p.Comments.Star3 = l.atoi(v)
     }
     if v, ok := m["star2"]; ok && v != "" {
-      p.Comments.Star2 = atoi(v)
+      p.Comments.Star2 = l.atoi(v)
     }
     if v, ok := m["star1"]; ok && v != "" {
-      p.Comments.Star1 = atoi(v)
+      p.Comments.Star1 = l.atoi(v)
     }
     if v, ok := m["image"]; ok && v != "" {
-      p.Comments.Image = atoi(v)
+      p.Comments.Image = l.atoi(v)
     }
     if v, ok := m["append"]; ok && v != "" {
-      p.Comments.Append = atoi(v)
+      p.Comments.Append = l.atoi(v)
     }
   }
 }
 
-// string转int，主要是数量的转换，如库存和销量，
-// 数量可能存在小数点和万，如1.4万，
-// 已经在JS中去掉加号、逗号和空格了
-func atoi(value string) int {
-  if value == "" {
-    return NoValue
-  }
-  init := float64(1)
-  if strings.Contains(value, "万") {
-    value = strings.TrimRight(value, "万")
-    init = 10000
+// 按脚本的type解析结果并保存在Product.Attributes中，没有值或解析失败时不保存
+func setAttribute(l *locale, s *script, value string, p *Product) {
+  var v interface{}
+  switch s.Type {
+  case "string":
+    value = strings.TrimSpace(value)
+    if value == "" {
+      return
+    }
+    v = value
+
+  case "int":
+    n := l.atoi(value)
+    if n == NoValue {
+      return
+    }
+    v = n
+
+  case "float":
+    f := l.atof(value)
+    if f == NoValue {
+      return
+    }
+    v = f
+
+  case "json":
+    value = strings.TrimSpace(value)
+    if value == "" || !json.Valid([]byte(value)) {
+      return
+    }
+    v = json.RawMessage(value)
+
+  case "urls":
+    arr := parseURLs(value, p.URL)
+    if len(arr) == 0 {
+      return
+    }
+    v = arr
+
+  default:
+    return
   }
-  v, e := strconv.ParseFloat(value, 64)
-  if e != nil {
-    return NoValue
+  if p.Attributes == nil {
+    p.Attributes = make(map[string]interface{}, 4)
   }
-  return int(v * init)
+  p.Attributes[s.Name] = v
 }
 
-// string转float64，价格转换，
-// 已经在JS中去掉货币符号、逗号和空格了
-func atof(value string) float64 {
-  if value == "" {
-    return NoValue
+// 解析链接列表，value是JSON数组或以空白分隔的链接，
+// 相对链接按base转换为绝对链接，只保留http和https的链接（去重）
+func parseURLs(value, base string) []string {
+  var arr []string
+  if json.Unmarshal([]byte(value), &arr) != nil {
+    arr = strings.Fields(value)
   }
-  v, e := strconv.ParseFloat(value, 64)
-  if e != nil {
-    return NoValue
+  b, _ := url.Parse(base)
+  ret := make([]string, 0, len(arr))
+  seen := make(map[string]bool, len(arr))
+  for _, v := range arr {
+    u, e := url.Parse(strings.TrimSpace(v))
+    if e != nil {
+      continue
+    }
+    if b != nil {
+      u = b.ResolveReference(u)
+    }
+    if u.Scheme != "http" && u.Scheme != "https" {
+      continue
+    }
+    s := u.String()
+    if !seen[s] {
+      seen[s] = true
+      ret = append(ret, s)
+    }
   }
-  return v
-}
-
-// 解析价格，
-// 如果是唯一价格，返回的len(slice)是1，
-// 如果是区间，返回的len(slice)是2
-func parsePrice(value string) []float64 {
-  ret := make([]float64, 0, 2)
-  if !strings.Contains(value, "-") && !strings.Contains(value, "~") {
-    ret = append(ret, atof(value))
-    return ret
-  }
-  arr := strings.Split(value, "-")
-  l := len(arr)
-  if l != 2 {
-    arr = strings.Split(value, "~")
-    l = len(arr)
-    if l != 2 {
-      ret = append(ret, NoValue)
-      return ret
-    }
-  }
-  ret = append(ret, atof(arr[0]), atof(arr[1]))
   return ret
 }
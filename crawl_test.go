@@ -0,0 +1,426 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/cdp"
+)
+
+const testRule = `
+name: "shop"
+source: 1
+match:
+  - "shop.test"
+chain:
+  - match:
+      - "m.shop.test"
+    index: "id=(\\d+)"
+    index_count: 4
+    template: "https://www.shop.test/item?id=$1"
+    alloc: 40
+id:
+  match:
+    - "id=(\\d+)"
+  index: 1
+scripts:
+  - name: "title"
+    script: "TITLE"
+  - name: "scroll"
+    script: "SCROLL"
+    async: true
+  - name: "price"
+    script: "PRICE($id)"
+`
+
+var testIDRegex = regexp.MustCompile(`id=(\d+)`)
+
+// 加载测试用的规则并设置为当前规则，返回恢复原规则的函数
+func setupTestRules(t *testing.T) (ruleSet, func()) {
+  dir, e := ioutil.TempDir("", "rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  ioutil.WriteFile(filepath.Join(dir, "shop.yaml"), []byte(testRule), 0644)
+  rules, problems := loadRules(dir)
+  if len(rules) != 1 {
+    t.Fatal(problems)
+  }
+  old := currentRules()
+  activeRules.Store(ruleSet(rules))
+  return ruleSet(rules), func() {
+    activeRules.Store(old)
+  }
+}
+
+// 假Chrome上测试规则的默认结果：标题是"item <id>"，价格是id
+func shopEvaluate(addr, expression string) (string, bool) {
+  id := ""
+  if arr := testIDRegex.FindStringSubmatch(addr); arr != nil {
+    id = arr[1]
+  }
+  switch {
+  case expression == "document.URL":
+    return addr, true
+  case expression == "TITLE":
+    return "item " + id, true
+  case strings.HasPrefix(expression, "PRICE"):
+    return id, true
+  }
+  return "", true
+}
+
+func TestDoCrawl(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = shopEvaluate
+  for _, id := range []string{"1", "2", "3"} {
+    addr, rule, chain := normalizeURL(rs, "https://www.shop.test/item?id="+id)
+    r := doCrawl(addr, rule, chain)
+    p := r.Product
+    if !r.ok() || p.ID != id || p.Title != "item "+id || p.Price != defaultLocale.atof(id) || p.Source != 1 {
+      t.Errorf("unexpected product %+v", p)
+    }
+  }
+  // 不支持的网站和匹配不到ID的链接不打开页面，也不重试
+  _, rule, _ := normalizeURL(rs, "https://www.shop.test/item?id=1")
+  for kind, r := range map[failKind]*crawlResult{
+    failUnsupported: doCrawl("https://www.other.test/item?id=1", nil, nil),
+    failNoID:        doCrawl("https://www.shop.test/list", rule, nil),
+  } {
+    if r.Kind != kind || r.retryable() {
+      t.Errorf("expect %s, got %s", kind, r)
+    }
+  }
+  // 标签页重复使用
+  if fc.created != 1 {
+    t.Errorf("expect 1 tab, created %d", fc.created)
+  }
+  if fc.count("SCROLL") != 3 || fc.count("PRICE(3)") != 1 {
+    t.Errorf("unexpected calls %v", fc.calls)
+  }
+}
+
+func TestDoCrawlLoadTimeout(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = shopEvaluate
+  // 页面一直没有加载完成，超时后仍然执行脚本
+  fc.Load = func(string) time.Duration {
+    return -1
+  }
+  start := time.Now()
+  r := doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=5"))
+  if d := time.Since(start); d < time.Second {
+    t.Errorf("expect to wait crawl_timeout, waited %v", d)
+  }
+  if p := r.Product; !r.ok() || p.ID != "5" || p.Price != 5 || r.Load < time.Second {
+    t.Errorf("unexpected result %s, product %+v", r, p)
+  }
+
+  // 超时后没抓到价格
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    if strings.HasPrefix(expression, "PRICE") {
+      return "", true
+    }
+    return shopEvaluate(addr, expression)
+  }
+  r = doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=5"))
+  if r.Kind != failTimeout || r.Field != "price" || !r.retryable() {
+    t.Errorf("unexpected result %s", r)
+  }
+}
+
+func TestDoCrawlHang(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    if strings.HasPrefix(expression, "PRICE") && strings.Contains(addr, "id=6") {
+      return "", false
+    }
+    return shopEvaluate(addr, expression)
+  }
+  r := doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=6"))
+  if p := r.Product; r.Kind != failTab || r.Field != "price" || p.ID != "6" || p.Title != "item 6" || p.Price != NoScript {
+    t.Errorf("unexpected result %s, product %+v", r, p)
+  }
+  // 卡死的标签页被关闭，下次抓取时创建新的标签页
+  r = doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=7"))
+  if !r.ok() || r.Product.Price != 7 {
+    t.Errorf("unexpected result %s", r)
+  }
+  if fc.created != 2 {
+    t.Errorf("expect 2 tabs, created %d", fc.created)
+  }
+  // 卡死的标签页由Chrome关闭（不在其他goroutine调用Tab.Close）
+  for i := 0; i < 50 && atomic.LoadInt32(&fc.closed) == 0; i++ {
+    time.Sleep(time.Millisecond * 20)
+  }
+  if atomic.LoadInt32(&fc.closed) == 0 {
+    t.Error("expect hung tab to be closed")
+  }
+}
+
+func TestDoCrawlDisconnect(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 2)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = shopEvaluate
+  var once sync.Once
+  fc.Disconnect = func(method string) bool {
+    disconnect := false
+    if method == cdp.Runtime.Evaluate {
+      once.Do(func() {
+        disconnect = true
+      })
+    }
+    return disconnect
+  }
+  r := doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=8"))
+  if p := r.Product; r.Kind != failTab || p.Title != "" || p.Price != NoScript {
+    t.Errorf("unexpected result %s, product %+v", r, p)
+  }
+  r = doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=8"))
+  if p := r.Product; !r.ok() || p.Title != "item 8" || p.Price != 8 {
+    t.Errorf("unexpected result %s, product %+v", r, p)
+  }
+}
+
+func TestNormalizeURL(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    // 短链接跳转到移动端页面
+    if expression == "document.URL" && strings.Contains(addr, "s.short") {
+      return "https://m.shop.test/detail?id=9", true
+    }
+    return shopEvaluate(addr, expression)
+  }
+
+  // 能直接转换的不需要打开页面
+  addr, rule, chain := normalizeURL(rs, "https://m.shop.test/detail?id=42&from=share")
+  if addr != "https://www.shop.test/item?id=42" || rule == nil || chain == nil {
+    t.Errorf("unexpected %s", addr)
+  }
+  addr, rule, chain = normalizeURL(rs, "https://www.shop.test/item?id=43")
+  if addr != "https://www.shop.test/item?id=43" || rule == nil || chain != nil {
+    t.Errorf("unexpected %s", addr)
+  }
+  if fc.count(cdp.Page.Navigate) != 0 {
+    t.Error("expect no navigation")
+  }
+
+  // 没有规则的链接需要打开页面得到跳转后的链接
+  addr, rule, _ = normalizeURL(rs, "https://s.short/abc")
+  if addr != "https://www.shop.test/item?id=9" || rule == nil {
+    t.Errorf("unexpected %s", addr)
+  }
+}
+
+func TestSetAttribute(t *testing.T) {
+  cases := []struct {
+    typ    string
+    value  string
+    expect string
+  }{
+    {"string", "  Anker  ", `"Anker"`},
+    {"string", " ", ""},
+    {"int", "1.4万+", "14000"},
+    {"int", "无", ""},
+    {"float", "运费￥12.50", "12.5"},
+    {"json", `{"a":[1,2]}`, `{"a":[1,2]}`},
+    {"json", `{"a":`, ""},
+    {"urls", `["/dp/B01","https://a.test/x","https://a.test/x","javascript:void(0)"]`, `["https://www.shop.test/dp/B01","https://a.test/x"]`},
+    {"urls", "https://a.test/1 https://a.test/2", `["https://a.test/1","https://a.test/2"]`},
+    {"urls", "[]", ""},
+  }
+  for _, c := range cases {
+    p := NewProduct()
+    p.URL = "https://www.shop.test/item?id=1"
+    setAttribute(nil, &script{Name: "x", Type: c.typ}, c.value, p)
+    v, ok := p.Attributes["x"]
+    if c.expect == "" {
+      if ok {
+        t.Errorf("%s %q: expect no attribute, got %v", c.typ, c.value, v)
+      }
+      continue
+    }
+    data, _ := json.Marshal(v)
+    if string(data) != c.expect {
+      t.Errorf("%s %q: expect %s, got %s", c.typ, c.value, c.expect, data)
+    }
+  }
+}
+
+func TestTraceCrawl(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    if expression == "document.URL" && strings.Contains(addr, "s.short") {
+      return "https://m.shop.test/detail?id=9", true
+    }
+    return shopEvaluate(addr, expression)
+  }
+
+  if !normalizesDirectly(rs, "https://m.shop.test/detail?id=42") || normalizesDirectly(rs, "https://s.short/abc") {
+    t.Error("unexpected direct normalization")
+  }
+  tr := &normalizeTrace{}
+  normalize(rs, "https://m.shop.test/detail?id=42", tr)
+  if tr.Rule != "shop" || tr.Chain != 0 || tr.Direct != "https://www.shop.test/item?id=42" || tr.Evaluated || tr.Output != tr.Direct {
+    t.Errorf("unexpected trace %+v", tr)
+  }
+  tr = &normalizeTrace{}
+  normalize(rs, "https://s.short/abc", tr)
+  if tr.Rule != "" || !tr.Evaluated || tr.DocumentURL != "https://m.shop.test/detail?id=9" || tr.FinalRule != "shop" || tr.Output != "https://www.shop.test/item?id=9" {
+    t.Errorf("unexpected trace %+v", tr)
+  }
+  buf := &bytes.Buffer{}
+  printNormalize(buf, tr, false)
+  if !strings.Contains(buf.String(), "document: https://m.shop.test/detail?id=9") {
+    t.Errorf("unexpected output %s", buf.String())
+  }
+
+  r := traceCrawl(rs, "https://www.shop.test/item?id=7")
+  if !r.ok() || len(r.Scripts) == 0 {
+    t.Fatalf("unexpected result %s", r)
+  }
+  found := false
+  for _, v := range r.Scripts {
+    if v.Name == "price" {
+      found = v.Value == "7"
+    }
+  }
+  if !found {
+    t.Error("expect price script traced")
+  }
+  buf.Reset()
+  printCrawl(buf, r, true)
+  ret := &crawlReport{}
+  if e := json.Unmarshal(buf.Bytes(), ret); e != nil || ret.Status != statusOK || ret.Product.ID != "7" || len(ret.Scripts) != len(r.Scripts) {
+    t.Errorf("unexpected output %s", buf.String())
+  }
+}
+
+func TestProcessProductsRetry(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 2)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  defer setupStore(t)()
+  oldInterval, oldShortener := retryInterval, shortener
+  retryInterval = time.Millisecond * 10
+  shortener = func(addr string) string {
+    return "https://t.cn/" + testIDRegex.FindStringSubmatch(addr)[1]
+  }
+  defer func() {
+    retryInterval, shortener = oldInterval, oldShortener
+  }()
+  var mu sync.Mutex
+  tries := make(map[string]int)
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    if strings.HasPrefix(expression, "PRICE(11)") {
+      // 第一次没抓到价格，重试时才抓到
+      mu.Lock()
+      tries[addr]++
+      n := tries[addr]
+      mu.Unlock()
+      if n == 1 {
+        return "", true
+      }
+    }
+    return shopEvaluate(addr, expression)
+  }
+  arr := []*Product{
+    {ID: "10", URL: "https://www.shop.test/item?id=10"},
+    {ID: "11", URL: "https://m.shop.test/detail?id=11"},
+    // ID和抓到的不一致，重试后仍然失败
+    {ID: "99", URL: "https://www.shop.test/item?id=12"},
+    nil,
+  }
+  payloads, results, rest := processProducts(arr)
+  if len(payloads) != 2 || rest != nil {
+    t.Fatalf("expect 2 payloads, got %d", len(payloads))
+  }
+  // 每个商品都有结果（包括没抓到的）
+  expect := []Result{
+    {ProductID: "10", URL: arr[0].URL, Status: statusOK, Attempts: 1},
+    {ProductID: "11", URL: arr[1].URL, Status: statusOK, Attempts: 2},
+    {ProductID: "99", URL: arr[2].URL, Status: string(failIDMismatch), Field: "id", Attempts: 3},
+  }
+  if len(results) != len(expect) {
+    t.Fatalf("expect %d results, got %d", len(expect), len(results))
+  }
+  for i, r := range results {
+    if *r != expect[i] {
+      t.Errorf("expect result %+v, got %+v", expect[i], *r)
+    }
+  }
+  for i, id := range []string{"10", "11"} {
+    p := payloads[i].Product
+    if p.ID != id || p.ShortURL != "https://t.cn/"+id || p.UpdateTime.IsZero() {
+      t.Errorf("unexpected product %+v", p)
+    }
+  }
+  if fc.count("PRICE(10)") != 1 || fc.count("PRICE(11)") != 2 || fc.count("PRICE(12)") != 3 {
+    t.Errorf("unexpected retries %d/%d/%d", fc.count("PRICE(10)"), fc.count("PRICE(11)"), fc.count("PRICE(12)"))
+  }
+}
+
+func TestProcessMessages(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 2)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  defer setupStore(t)()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  fc.Evaluate = shopEvaluate
+  arr := []*Message{
+    {ID: "m1", Content: "快来看看 https://m.shop.test/detail?id=21 好便宜"},
+    {ID: "m2", Content: "&lt;msg&gt;&lt;appmsg&gt;&lt;title&gt;t&lt;/title&gt;&lt;url&gt;https://www.shop.test/item?id=22&amp;amp;a=1&lt;/url&gt;&lt;/appmsg&gt;&lt;/msg&gt;"},
+    // 提取不到链接，不会重试
+    {ID: "m3", Content: "没有链接"},
+  }
+  payloads, results, _ := processMessages(arr)
+  if len(payloads) != 2 {
+    t.Fatalf("expect 2 payloads, got %d", len(payloads))
+  }
+  if len(results) != 3 || results[0].Status != statusOK || results[0].ProductID != "21" {
+    t.Fatalf("unexpected results %v", results)
+  }
+  if r := results[2]; r.MessageID != "m3" || r.Status != string(failNoURL) || r.Attempts != 1 {
+    t.Errorf("unexpected result %+v", r)
+  }
+  for i, id := range []string{"21", "22"} {
+    if payloads[i].Message != arr[i] || payloads[i].Product.ID != id {
+      t.Errorf("unexpected payload %+v", payloads[i])
+    }
+  }
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+  "encoding/binary"
+  "encoding/json"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+// 已经提交过的新商品，key是商品ID，value是提交时间（8字节纳秒，大端），
+// 同一个商品不会重复提交，超过store.ttl天后删除（可以再次被发现）
+var bucketDiscovered = []byte("discovered")
+
+// 从抓到的商品中发现新商品：规则的discover脚本（type为urls）得到的链接，
+// 转换为标准URL，去掉不支持的、任务中已有的、store中已有的和已经提交过的，
+// 每个任务最多检查task.discover.candidates个链接、提交task.discover.budget个，
+// 作为新的任务提交到发现队列，由Dispatcher安排抓取，失败时只记录日志，不影响任务本身
+func discoverProducts(taskID string, payloads []*Payload) {
+  budget := Conf.Task.Discover.Budget
+  if budget <= 0 || len(payloads) == 0 {
+    return
+  }
+  candidates := Conf.Task.Discover.Candidates
+  if candidates <= 0 {
+    candidates = budget * 10
+  }
+  rs := currentRules()
+  seen := make(map[string]bool, len(payloads))
+  for _, payload := range payloads {
+    if payload.Product != nil {
+      seen[payload.Product.ID] = true
+    }
+  }
+  found := make([]*Payload, 0, budget)
+  for _, payload := range payloads {
+    p := payload.Product
+    if p == nil || len(found) >= budget || candidates <= 0 {
+      continue
+    }
+    rule := rs.findRuleBySource(p.Source)
+    if rule == nil || rule.Discover == "" {
+      continue
+    }
+    urls, _ := p.Attributes[rule.Discover].([]string)
+    for _, u := range urls {
+      if len(found) >= budget || candidates <= 0 {
+        break
+      }
+      candidates--
+      np := discoverProduct(rs, u, seen)
+      if np != nil {
+        found = append(found, &Payload{Product: np})
+        metricDiscovered.inc(rule.Name)
+      }
+    }
+  }
+  if len(found) == 0 {
+    return
+  }
+  data, _ := json.Marshal(&Task{ID: taskID, ReportTime: times.Now(), Payloads: found})
+  dump(taskID, "discover", data)
+  e := queue.discover(data)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Discover")
+    return
+  }
+  now := times.Now()
+  for _, v := range found {
+    markDiscovered(v.Product.ID, now)
+  }
+  metricTasksReported.inc("discover")
+  logger.Info().Msgf("discover products, ok, count=%d", len(found))
+}
+
+// 链接对应的新商品，只处理能直接匹配到规则的链接，
+// 不调用normalizeURL（转换不了时会打开页面，不受调度和抓取限制），
+// 不是新商品时返回nil
+func discoverProduct(rs ruleSet, addr string, seen map[string]bool) *Product {
+  rule, chain := rs.findChainByURL(addr)
+  if rule == nil {
+    return nil
+  }
+  if chain != nil {
+    addr = matchURLFromChain(addr, chain)
+  }
+  id := matchIDFromRule(addr, rule)
+  if id == "" || seen[id] {
+    return nil
+  }
+  seen[id] = true
+  if store.Get(bucketProducts, []byte(id)) != nil || store.Get(bucketDiscovered, []byte(id)) != nil {
+    return nil
+  }
+  return &Product{ID: id, URL: addr, Source: rule.Source, Currency: rule.Currency}
+}
+
+func markDiscovered(id string, t time.Time) {
+  v := make([]byte, 8)
+  binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+  e := store.UpdateV(bucketDiscovered, []byte(id), v)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Store Discovered")
+  }
+}
+
+// 删除before之前提交的新商品记录，返回删除的数量
+func evictDiscovered(before time.Time) (int, error) {
+  ids := make([][]byte, 0, 16)
+  e := store.EachKV(bucketDiscovered, func(k, v []byte, n int) error {
+    if len(v) != 8 || time.Unix(0, int64(binary.BigEndian.Uint64(v))).Before(before) {
+      ids = append(ids, append([]byte(nil), k...))
+    }
+    return nil
+  })
+  if e != nil || len(ids) == 0 {
+    return 0, e
+  }
+  e = store.UpdateB(bucketDiscovered, func(b *bbolt.Bucket) error {
+    for _, id := range ids {
+      if e := b.Delete(id); e != nil {
+        return e
+      }
+    }
+    return nil
+  })
+  if e != nil {
+    return 0, e
+  }
+  return len(ids), nil
+}
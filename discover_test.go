@@ -0,0 +1,108 @@
+package main
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+func TestDiscoverProducts(t *testing.T) {
+  dir, e := ioutil.TempDir("", "rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  rule := testRule + `
+  - name: "recommends"
+    type: "urls"
+    script: "RECOMMENDS"
+discover: "recommends"
+`
+  ioutil.WriteFile(filepath.Join(dir, "shop.yaml"), []byte(rule), 0644)
+  rules, problems := loadRules(dir)
+  if len(rules) != 1 {
+    t.Fatal(problems)
+  }
+  old := currentRules()
+  activeRules.Store(ruleSet(rules))
+  defer activeRules.Store(old)
+  conf, teardown := setupTaskQueue(t)
+  defer teardown()
+  conf.Discover = filepath.Join(filepath.Dir(conf.Put), "discover.jsonl")
+  Conf.Task.Discover.Budget = 2
+  defer func() {
+    Conf.Task.Discover.Budget = 0
+  }()
+  store.UpdateV(bucketProducts, []byte("2"), []byte(`{"id":"2"}`))
+  // 发现商品时不打开页面
+  oldTabs := tabs
+  tabs = nil
+  defer func() {
+    tabs = oldTabs
+  }()
+
+  p := &Product{ID: "1", Source: 1, URL: "https://www.shop.test/item?id=1", Attributes: map[string]interface{}{
+    "recommends": []string{
+      "https://m.shop.test/share/8",
+      "https://m.shop.test/detail?id=2",
+      "https://www.shop.test/item?id=1",
+      "https://other.test/item?id=6",
+      "https://m.shop.test/detail?id=3",
+      "https://www.shop.test/item?id=3",
+      "https://www.shop.test/item?id=4",
+      "https://www.shop.test/item?id=5",
+    },
+  }}
+  payloads := []*Payload{{Product: p}}
+  discoverProducts("t1", payloads)
+  lines := readLines(t, conf.Discover)
+  buf := &bytes.Buffer{}
+  writeMetrics(buf)
+  if !strings.Contains(buf.String(), `hiprice_discovered_products_total{rule="shop"}`) {
+    t.Errorf("expect discovered products in metrics:\n%s", buf.String())
+  }
+  if len(lines) != 1 || !strings.Contains(lines[0], `"id":"t1"`) ||
+    !strings.Contains(lines[0], `{"product":{"id":"3","url":"https://www.shop.test/item?id=3","source":1,`) ||
+    !strings.Contains(lines[0], `{"product":{"id":"4","url":"https://www.shop.test/item?id=4","source":1,`) ||
+    strings.Contains(lines[0], `"id":"5"`) {
+    t.Errorf("unexpected discovered %v", lines)
+  }
+
+  // 已经提交过的不再提交
+  discoverProducts("t2", payloads)
+  lines = readLines(t, conf.Discover)
+  if len(lines) != 2 || !strings.Contains(lines[1], `"id":"5"`) || strings.Contains(lines[1], `"id":"3"`) {
+    t.Errorf("unexpected discovered %v", lines)
+  }
+  discoverProducts("t3", payloads)
+  if n := len(readLines(t, conf.Discover)); n != 2 {
+    t.Errorf("expect nothing discovered, got %d lines", n)
+  }
+
+  n, e := evictDiscovered(times.Now().Add(time.Hour))
+  if e != nil || n != 3 {
+    t.Errorf("expect 3 evicted, got %d, %v", n, e)
+  }
+
+  // 检查的链接数有上限，不支持的链接也计算在内
+  Conf.Task.Discover.Candidates = 3
+  defer func() {
+    Conf.Task.Discover.Candidates = 0
+  }()
+  p.Attributes["recommends"] = []string{
+    "https://other.test/item?id=6",
+    "https://other.test/item?id=7",
+    "https://other.test/item?id=8",
+    "https://www.shop.test/item?id=9",
+  }
+  discoverProducts("t4", payloads)
+  if n := len(readLines(t, conf.Discover)); n != 2 {
+    t.Errorf("expect nothing discovered, got %d lines", n)
+  }
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+  "compress/gzip"
+  "fmt"
+  "hash/crc32"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 检查并删除过期dump的间隔
+const dumpCleanInterval = time.Hour
+
+// 取到的任务和提交的报告保存在log.dir/dump/<日期>/<任务ID>_<name>.json（gzip时为.json.gz），
+// 用于排查问题和replay，name为reserve、report_messages或report_products
+func dump(taskID, name string, data []byte) {
+  c := Conf.Log.Dump
+  if c.Disable || taskID == "" || len(data) == 0 || !dumpSampled(taskID) {
+    return
+  }
+  dir := filepath.Join(Conf.Log.Dir, "dump", times.NowStrFormat(times.DateFormat3))
+  e := os.MkdirAll(dir, 0755)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Dump")
+    return
+  }
+  file := filepath.Join(dir, fmt.Sprintf("%s_%s.json", taskID, name))
+  if c.Gzip {
+    file += ".gz"
+  }
+  e = writeDump(file, data, c.Gzip)
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: Dump, file=%s", file)
+  }
+}
+
+func writeDump(file string, data []byte, compress bool) error {
+  f, e := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if e != nil {
+    return e
+  }
+  var w io.Writer = f
+  var gw *gzip.Writer
+  if compress {
+    gw = gzip.NewWriter(f)
+    w = gw
+  }
+  _, e = w.Write(data)
+  if gw != nil {
+    if e2 := gw.Close(); e == nil {
+      e = e2
+    }
+  }
+  if e2 := f.Close(); e == nil {
+    e = e2
+  }
+  return e
+}
+
+// 读取dump的文件，.gz结尾的先解压
+func readDump(file string) ([]byte, error) {
+  f, e := os.Open(file)
+  if e != nil {
+    return nil, e
+  }
+  defer f.Close()
+  if !strings.HasSuffix(file, ".gz") {
+    return ioutil.ReadAll(f)
+  }
+  r, e := gzip.NewReader(f)
+  if e != nil {
+    return nil, fmt.Errorf("%s: %s", file, e)
+  }
+  defer r.Close()
+  return ioutil.ReadAll(r)
+}
+
+// 按任务ID取样，同一个任务的reserve和报告一起保留或一起丢弃
+func dumpSampled(taskID string) bool {
+  n := Conf.Log.Dump.Sample
+  if n <= 1 {
+    return true
+  }
+  return crc32.ChecksumIEEE([]byte(taskID))%uint32(n) == 0
+}
+
+// 定时删除超过max_age天或超出max_size（MB）的dump，都为0时不启动
+func dumpCleanLoop() {
+  c := Conf.Log.Dump
+  if c.MaxAge <= 0 && c.MaxSize <= 0 {
+    return
+  }
+  maxAge := time.Hour * 24 * time.Duration(c.MaxAge)
+  maxSize := int64(c.MaxSize) * 1024 * 1024
+  for {
+    n, e := cleanDumps(filepath.Join(Conf.Log.Dir, "dump"), maxAge, maxSize)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Clean dumps")
+    } else if n > 0 {
+      logger.Info().Msgf("clean dumps, ok, %d files deleted", n)
+    }
+    if !sleep(dumpCleanInterval) {
+      return
+    }
+  }
+}
+
+// 先删除修改时间早于maxAge的文件，总大小仍超过maxSize时从最旧的开始删除，
+// 最后删除空的日期目录，maxAge和maxSize为0表示不限制，返回删除的文件数
+func cleanDumps(dir string, maxAge time.Duration, maxSize int64) (int, error) {
+  var files []os.FileInfo
+  var paths []string
+  e := filepath.Walk(dir, func(path string, info os.FileInfo, e error) error {
+    if e != nil {
+      return e
+    }
+    if !info.IsDir() {
+      files = append(files, info)
+      paths = append(paths, path)
+    }
+    return nil
+  })
+  if e != nil {
+    if os.IsNotExist(e) {
+      return 0, nil
+    }
+    return 0, e
+  }
+  // 按修改时间从新到旧排序
+  index := make([]int, len(files))
+  for i := range index {
+    index[i] = i
+  }
+  sort.Slice(index, func(i, j int) bool {
+    return files[index[i]].ModTime().After(files[index[j]].ModTime())
+  })
+  now := times.Now()
+  count := 0
+  var size int64
+  // 超出大小后更旧的文件也都删除
+  full := false
+  for _, i := range index {
+    f := files[i]
+    switch {
+    case maxAge > 0 && now.Sub(f.ModTime()) > maxAge:
+    case maxSize > 0 && (full || size+f.Size() > maxSize):
+      full = true
+    default:
+      size += f.Size()
+      continue
+    }
+    if e := os.Remove(paths[i]); e != nil {
+      return count, e
+    }
+    count++
+  }
+  subdirs, e := ioutil.ReadDir(dir)
+  if e != nil {
+    return count, e
+  }
+  for _, d := range subdirs {
+    if d.IsDir() {
+      // 不为空时删除失败
+      os.Remove(filepath.Join(dir, d.Name()))
+    }
+  }
+  return count, nil
+}
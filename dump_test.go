@@ -0,0 +1,92 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+func TestDump(t *testing.T) {
+  dir, e := ioutil.TempDir("", "dump")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  oldLog := Conf.Log
+  defer func() {
+    Conf.Log = oldLog
+  }()
+  Conf.Log = LogConf{Dir: dir}
+  day := filepath.Join(dir, "dump", times.NowStrFormat(times.DateFormat3))
+
+  dump("t1", "reserve", []byte(`{"id":"t1"}`))
+  info, e := os.Stat(filepath.Join(day, "t1_reserve.json"))
+  if e != nil || info.Mode().Perm() != 0644 {
+    t.Fatalf("unexpected dump %v %v", info, e)
+  }
+  Conf.Log.Dump.Gzip = true
+  dump("t1", "report_products", []byte(`{"id":"t1","results":[{"product_id":"1","status":"ok"}]}`))
+  report, e := readReport(findDump(day, "t1_report_products"))
+  if e != nil || report.ID != "t1" || len(report.Results) != 1 {
+    t.Errorf("unexpected report %v %v", report, e)
+  }
+
+  Conf.Log.Dump = DumpConf{Sample: 2}
+  n := 0
+  for _, id := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+    dump(id, "reserve", []byte("{}"))
+    if findDump(day, id+"_reserve") != "" {
+      n++
+    }
+  }
+  if n == 0 || n == 8 {
+    t.Errorf("expect some tasks sampled, got %d", n)
+  }
+  Conf.Log.Dump = DumpConf{Disable: true}
+  dump("t2", "reserve", []byte("{}"))
+  if findDump(day, "t2_reserve") != "" {
+    t.Error("expect no dump when disabled")
+  }
+}
+
+func TestCleanDumps(t *testing.T) {
+  dir, e := ioutil.TempDir("", "dump")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  now := time.Now()
+  write := func(day, name string, size int, age time.Duration) {
+    os.MkdirAll(filepath.Join(dir, day), 0755)
+    f := filepath.Join(dir, day, name)
+    ioutil.WriteFile(f, make([]byte, size), 0644)
+    os.Chtimes(f, now.Add(-age), now.Add(-age))
+  }
+  write("20200101", "old.json", 10, time.Hour*24*10)
+  write("20200105", "a.json", 10, time.Hour*3)
+  write("20200105", "b.json", 10, time.Hour*2)
+  write("20200106", "c.json", 10, time.Hour)
+
+  // 超过7天的删除，剩下的最多保留25字节（只保留b和c）
+  n, e := cleanDumps(dir, time.Hour*24*7, 25)
+  if e != nil || n != 2 {
+    t.Fatalf("expect 2 deleted, got %d %v", n, e)
+  }
+  for name, exist := range map[string]bool{
+    "20200101":        false,
+    "20200105/a.json": false,
+    "20200105/b.json": true,
+    "20200106/c.json": true,
+  } {
+    if _, e := os.Stat(filepath.Join(dir, name)); os.IsNotExist(e) == exist {
+      t.Errorf("%s, expect exist=%v", name, exist)
+    }
+  }
+  if n, _ := cleanDumps(filepath.Join(dir, "none"), time.Hour, 0); n != 0 {
+    t.Error("expect nothing deleted")
+  }
+}
@@ -142,16 +142,7 @@ func validateChanged(p *Product, price, priceLow, priceHigh float64) bool {
   if price == NoValue {
     return true
   }
-  if price == RangePrice && p.Price == RangePrice {
-    if priceLow < 0 || priceHigh < 0 || p.PriceLow < 0 || p.PriceHigh < 0 {
-      return false
-    }
-    return priceLow != p.PriceLow || priceHigh != p.PriceHigh
-  }
-  if price >= 0 && p.Price >= 0 {
-    return price != p.Price
-  }
-  return false
+  return priceChanged(&Product{Price: price, PriceLow: priceLow, PriceHigh: priceHigh}, p)
 }
 
 func main2() {
@@ -165,8 +156,9 @@ func main2() {
   }
   payloads := make([]*Payload, 0, len(arr))
   for _, m := range arr {
-    p := crawlMessage(m)
-    if p == nil || p.ID == "" || p.Price == NoScript || p.Price == NoValue {
+    r := crawlMessage(currentRules(), m)
+    p := r.Product
+    if !r.ok() || p.Price == NoScript {
       continue
     }
     payloads = append(payloads, &Payload{Message: m, Product: p})
@@ -0,0 +1,283 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode"
+)
+
+var spaceRegex = regexp.MustCompile(`\s+`)
+
+// 声明式的提取规则，是script的另一种写法，
+// 由选择器和取值来源生成JS（只负责取值），取到的值再依次经过transforms处理
+type extractor struct {
+  // 依次尝试的CSS选择器，使用第一个能选择到元素的选择器
+  Selectors []string `yaml:"selectors"`
+
+  // 取值来源：
+  // text（默认）：textContent，
+  // html：innerHTML，
+  // value：表单元素的value，
+  // attr:<name>：属性（如attr:content），
+  // prop:<name>：DOM属性（如prop:href，得到的是完整的URL）
+  Source string `yaml:"source"`
+
+  // 是否取选择到的所有元素，默认只取第一个
+  All bool `yaml:"all"`
+
+  // 依次执行的处理，每个处理的输入和输出都是字符串数组
+  Transforms []*transform `yaml:"transforms"`
+}
+
+// 一个处理，YAML中可以写成：
+// - trim
+// - regex: "剩(\\d+)件"
+// - replace: [",", "."]
+type transform struct {
+  Name string
+  Args []string
+
+  apply func([]string) []string
+}
+
+// 执行计划，由extractor编译而来
+type plan struct {
+  expression string
+  transforms []*transform
+}
+
+func (t *transform) UnmarshalYAML(unmarshal func(interface{}) error) error {
+  var name string
+  if e := unmarshal(&name); e == nil {
+    t.Name = name
+    return nil
+  }
+  m := make(map[string]interface{}, 1)
+  if e := unmarshal(&m); e != nil {
+    return e
+  }
+  if len(m) != 1 {
+    return errors.New("transform must have exactly one name")
+  }
+  for k, v := range m {
+    t.Name = k
+    switch arg := v.(type) {
+    case []interface{}:
+      for _, a := range arg {
+        t.Args = append(t.Args, fmt.Sprint(a))
+      }
+    case nil:
+    default:
+      t.Args = []string{fmt.Sprint(arg)}
+    }
+  }
+  return nil
+}
+
+func (ex *extractor) compile() (*plan, error) {
+  if len(ex.Selectors) == 0 {
+    return nil, errors.New("no selectors")
+  }
+  var value string
+  switch {
+  case ex.Source == "" || ex.Source == "text":
+    value = "e.textContent"
+  case ex.Source == "html":
+    value = "e.innerHTML"
+  case ex.Source == "value":
+    value = "e.value"
+  case strings.HasPrefix(ex.Source, "attr:"):
+    value = fmt.Sprintf("e.getAttribute(%s)", jsString(ex.Source[5:]))
+  case strings.HasPrefix(ex.Source, "prop:"):
+    value = fmt.Sprintf("e[%s]", jsString(ex.Source[5:]))
+  default:
+    return nil, fmt.Errorf("unknown source %q", ex.Source)
+  }
+  selectors, _ := json.Marshal(ex.Selectors)
+  // 只取第一个元素时，取到值后直接跳出循环
+  next := "break;"
+  if ex.All {
+    next = ""
+  }
+  ret := &plan{
+    expression: fmt.Sprintf("{let v666 = [];for (let s of %s) {let arr = document.querySelectorAll(s);if (arr.length > 0) {for (let e of arr) {let v = %s;v666.push(v === null || v === undefined ? '' : v + '');%s}break;}}JSON.stringify(v666);}", selectors, value, next),
+    transforms: ex.Transforms,
+  }
+  for _, t := range ex.Transforms {
+    e := t.compile()
+    if e != nil {
+      return nil, fmt.Errorf("transform %q: %s", t.Name, e)
+    }
+  }
+  return ret, nil
+}
+
+// 处理JS的返回值（JSON数组），返回第一个非空的值
+func (pl *plan) apply(value string) string {
+  var values []string
+  if json.Unmarshal([]byte(value), &values) != nil {
+    return ""
+  }
+  for _, t := range pl.transforms {
+    values = t.apply(values)
+  }
+  for _, v := range values {
+    if v != "" {
+      return v
+    }
+  }
+  return ""
+}
+
+func (t *transform) compile() error {
+  each := func(f func(string) string) func([]string) []string {
+    return func(values []string) []string {
+      for i, v := range values {
+        values[i] = f(v)
+      }
+      return values
+    }
+  }
+  arg := func(i int, def string) string {
+    if i < len(t.Args) {
+      return t.Args[i]
+    }
+    return def
+  }
+  switch t.Name {
+  case "trim":
+    t.apply = each(strings.TrimSpace)
+
+  case "collapse_space":
+    t.apply = each(func(s string) string {
+      return strings.TrimSpace(spaceRegex.ReplaceAllString(s, " "))
+    })
+
+  case "remove_space":
+    t.apply = each(func(s string) string {
+      return spaceRegex.ReplaceAllString(s, "")
+    })
+
+  case "strip_currency":
+    t.apply = each(func(s string) string {
+      return strings.TrimSpace(strings.Map(func(r rune) rune {
+        if unicode.Is(unicode.Sc, r) {
+          return -1
+        }
+        return r
+      }, s))
+    })
+
+  case "remove_thousands":
+    sep := arg(0, ",")
+    t.apply = each(func(s string) string {
+      return strings.Replace(s, sep, "", -1)
+    })
+
+  case "remove":
+    if len(t.Args) == 0 {
+      return errors.New("missing argument")
+    }
+    t.apply = each(func(s string) string {
+      for _, v := range t.Args {
+        s = strings.Replace(s, v, "", -1)
+      }
+      return s
+    })
+
+  case "replace":
+    if len(t.Args) != 2 {
+      return errors.New("need 2 arguments")
+    }
+    t.apply = each(func(s string) string {
+      return strings.Replace(s, t.Args[0], t.Args[1], -1)
+    })
+
+  case "regex":
+    if len(t.Args) == 0 {
+      return errors.New("missing argument")
+    }
+    re, e := regexp.Compile(t.Args[0])
+    if e != nil {
+      return e
+    }
+    group := 0
+    if re.NumSubexp() > 0 {
+      group = 1
+    }
+    if len(t.Args) > 1 {
+      group, e = strconv.Atoi(t.Args[1])
+      if e != nil || group < 0 || group > re.NumSubexp() {
+        return fmt.Errorf("invalid group %q", t.Args[1])
+      }
+    }
+    // 不匹配的值会被丢弃
+    t.apply = func(values []string) []string {
+      ret := make([]string, 0, len(values))
+      for _, v := range values {
+        if arr := re.FindStringSubmatch(v); arr != nil {
+          ret = append(ret, arr[group])
+        }
+      }
+      return ret
+    }
+
+  case "split":
+    if len(t.Args) == 0 {
+      return errors.New("missing argument")
+    }
+    t.apply = func(values []string) []string {
+      ret := make([]string, 0, len(values))
+      for _, v := range values {
+        ret = append(ret, strings.Split(v, t.Args[0])...)
+      }
+      return ret
+    }
+
+  case "join":
+    sep := arg(0, "")
+    t.apply = func(values []string) []string {
+      return []string{strings.Join(values, sep)}
+    }
+
+  case "compact":
+    t.apply = func(values []string) []string {
+      ret := make([]string, 0, len(values))
+      for _, v := range values {
+        if v != "" {
+          ret = append(ret, v)
+        }
+      }
+      return ret
+    }
+
+  case "first":
+    t.apply = func(values []string) []string {
+      if len(values) > 1 {
+        return values[:1]
+      }
+      return values
+    }
+
+  case "last":
+    t.apply = func(values []string) []string {
+      if len(values) > 1 {
+        return values[len(values)-1:]
+      }
+      return values
+    }
+
+  default:
+    return errors.New("unknown transform")
+  }
+  return nil
+}
+
+func jsString(s string) string {
+  data, _ := json.Marshal(s)
+  return string(data)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+  "testing"
+
+  "gopkg.in/yaml.v2"
+)
+
+func TestExtractorApply(t *testing.T) {
+  cases := []struct {
+    transforms string
+    value      string
+    expect     string
+  }{
+    {`[collapse_space]`, `["  Apple\n  iPhone  X "]`, "Apple iPhone X"},
+    {`[remove_space, remove_thousands, {remove: "+"}]`, `["1, 234 +"]`, "1234"},
+    {`[strip_currency, remove_thousands]`, `["￥1,299.00"]`, "1299.00"},
+    {`[strip_currency, {remove_thousands: "."}, {replace: [",", "."]}]`, `["1.234,56 €"]`, "1234.56"},
+    {`[{regex: "剩(\\d+)件"}]`, `["现在有货", "仅剩3件"]`, "3"},
+    {`[{regex: ["(\\d+)-(\\d+)", 2]}]`, `["10-20"]`, "20"},
+    {`[{split: "›"}, trim, compact, {join: "_"}]`, `["家电 › 热水器 ›  燃气热水器"]`, "家电_热水器_燃气热水器"},
+    {`[last]`, `["1", "2", "3"]`, "3"},
+    {`[trim]`, `["", "  ", "x"]`, "x"},
+    {`[trim]`, `[]`, ""},
+    {`[trim]`, `not json`, ""},
+  }
+  for i, c := range cases {
+    ex := &extractor{Selectors: []string{"div"}}
+    if e := yaml.Unmarshal([]byte(c.transforms), &ex.Transforms); e != nil {
+      t.Fatalf("case %d: %s", i, e)
+    }
+    pl, e := ex.compile()
+    if e != nil {
+      t.Fatalf("case %d: %s", i, e)
+    }
+    if v := pl.apply(c.value); v != c.expect {
+      t.Errorf("case %d: expect %q, got %q", i, c.expect, v)
+    }
+  }
+}
+
+func TestExtractorCompileError(t *testing.T) {
+  cases := []*extractor{
+    {},
+    {Selectors: []string{"div"}, Source: "style"},
+    {Selectors: []string{"div"}, Transforms: []*transform{{Name: "upper"}}},
+    {Selectors: []string{"div"}, Transforms: []*transform{{Name: "regex", Args: []string{"("}}}},
+    {Selectors: []string{"div"}, Transforms: []*transform{{Name: "regex", Args: []string{"(a)", "2"}}}},
+    {Selectors: []string{"div"}, Transforms: []*transform{{Name: "replace", Args: []string{","}}}},
+  }
+  for i, ex := range cases {
+    if _, e := ex.compile(); e == nil {
+      t.Errorf("case %d: expect error", i)
+    }
+  }
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+  "github.com/kwf2030/commons/cdp"
+)
+
+// 进程内的假Chrome，实现cdp.Chrome和cdp.Tab用到的/json接口和WebSocket协议，
+// 通过回调控制页面加载时间、表达式的结果、不响应和断开连接
+type fakeChrome struct {
+  srv *httptest.Server
+
+  // 收到Page.navigate后多久发送Page.loadEventFired，返回负数表示不发送
+  Load func(addr string) time.Duration
+
+  // Runtime.evaluate的结果，addr是当前页面的链接，
+  // 第二个返回值为false表示不响应（模拟Chrome卡死）
+  Evaluate func(addr, expression string) (string, bool)
+
+  // 返回true表示收到该请求时断开连接（模拟Chrome崩溃）
+  Disconnect func(method string) bool
+
+  // 创建和关闭的标签页数量
+  created int32
+  closed  int32
+
+  mu sync.Mutex
+  // 所有收到的请求，格式是method或method(url/expression)
+  calls []string
+  // 标签页的WebSocket连接，关闭标签页时断开
+  conns map[string]*websocket.Conn
+}
+
+func newFakeChrome() *fakeChrome {
+  fc := &fakeChrome{
+    Load: func(string) time.Duration {
+      return time.Millisecond * 10
+    },
+    Evaluate: func(addr, expression string) (string, bool) {
+      if expression == "document.URL" {
+        return addr, true
+      }
+      return "", true
+    },
+    Disconnect: func(string) bool {
+      return false
+    },
+    conns: make(map[string]*websocket.Conn),
+  }
+  mux := http.NewServeMux()
+  mux.HandleFunc("/json/new", fc.handleNew)
+  mux.HandleFunc("/json/close/", func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(&fc.closed, 1)
+    fc.mu.Lock()
+    if conn := fc.conns[strings.TrimPrefix(r.URL.Path, "/json/close/")]; conn != nil {
+      conn.Close()
+    }
+    fc.mu.Unlock()
+    w.Write([]byte("Target is closing"))
+  })
+  mux.HandleFunc("/json/activate/", func(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("Target activated"))
+  })
+  mux.HandleFunc("/devtools/page/", fc.handleWS)
+  fc.srv = httptest.NewServer(mux)
+  return fc
+}
+
+func (fc *fakeChrome) chrome() cdp.Chrome {
+  return cdp.Chrome(fc.srv.URL + "/json")
+}
+
+func (fc *fakeChrome) close() {
+  fc.srv.Close()
+}
+
+func (fc *fakeChrome) record(call string) {
+  fc.mu.Lock()
+  fc.calls = append(fc.calls, call)
+  fc.mu.Unlock()
+}
+
+// 收到的请求中包含s的数量
+func (fc *fakeChrome) count(s string) int {
+  fc.mu.Lock()
+  defer fc.mu.Unlock()
+  n := 0
+  for _, c := range fc.calls {
+    if strings.Contains(c, s) {
+      n++
+    }
+  }
+  return n
+}
+
+func (fc *fakeChrome) handleNew(w http.ResponseWriter, r *http.Request) {
+  id := fmt.Sprintf("TAB%d", atomic.AddInt32(&fc.created, 1))
+  json.NewEncoder(w).Encode(map[string]string{
+    "id":                   id,
+    "type":                 "page",
+    "url":                  "about:blank",
+    "webSocketDebuggerUrl": "ws" + strings.TrimPrefix(fc.srv.URL, "http") + "/devtools/page/" + id,
+  })
+}
+
+func (fc *fakeChrome) handleWS(w http.ResponseWriter, r *http.Request) {
+  conn, e := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+  if e != nil {
+    return
+  }
+  defer conn.Close()
+  id := strings.TrimPrefix(r.URL.Path, "/devtools/page/")
+  fc.mu.Lock()
+  fc.conns[id] = conn
+  fc.mu.Unlock()
+  var wmu sync.Mutex
+  write := func(v interface{}) {
+    wmu.Lock()
+    conn.WriteJSON(v)
+    wmu.Unlock()
+  }
+  addr := "about:blank"
+  for {
+    msg := &cdp.Message{}
+    if conn.ReadJSON(msg) != nil {
+      return
+    }
+    if fc.Disconnect(msg.Method) {
+      fc.record(msg.Method + "(disconnect)")
+      return
+    }
+    result := cdp.Result{}
+    switch msg.Method {
+    case cdp.Page.Navigate:
+      addr, _ = msg.Params["url"].(string)
+      fc.record(msg.Method + "(" + addr + ")")
+      if d := fc.Load(addr); d >= 0 {
+        time.AfterFunc(d, func() {
+          write(&cdp.Message{Method: cdp.Page.LoadEventFired, Params: cdp.Params{"timestamp": 1}})
+        })
+      }
+      result["frameId"] = "FRAME"
+
+    case cdp.Runtime.Evaluate:
+      expression, _ := msg.Params["expression"].(string)
+      fc.record(msg.Method + "(" + expression + ")")
+      v, ok := fc.Evaluate(addr, expression)
+      if !ok {
+        continue
+      }
+      result["result"] = map[string]interface{}{"type": "string", "value": v}
+
+    case getTargetInfo:
+      result["targetInfo"] = map[string]interface{}{"targetId": id, "type": "page", "url": addr}
+
+    case cdp.Browser.GetVersion:
+      fc.record(msg.Method)
+      result["product"] = "FakeChrome/1.0"
+
+    default:
+      fc.record(msg.Method)
+    }
+    write(&cdp.Message{Id: msg.Id, Result: result})
+  }
+}
+
+// 使用假Chrome初始化标签页池，返回恢复原配置的函数
+func setupFakeChrome(t *testing.T, size int) (*fakeChrome, func()) {
+  fc := newFakeChrome()
+  old := Conf.Task
+  Conf.Task.CrawlTimeout = 1
+  Conf.Task.CrawlRetry = 3
+  Conf.Task.CrawlDuration = 0
+  Conf.Task.Politeness = PolitenessConf{}
+  chrome = fc.chrome()
+  tabs = newTabPool(chrome, size)
+  return fc, func() {
+    Conf.Task = old
+    fc.close()
+  }
+}
+
+func TestFakeChrome(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  tab, e := tabs.get()
+  if e != nil {
+    t.Fatal(e)
+  }
+  if !navigate(tab, "https://example.com/") {
+    t.Fatal("navigate failed")
+  }
+  v, ok := evaluate(tab, "document.URL")
+  if !ok || v != "https://example.com/" {
+    t.Errorf("expect url, got %q", v)
+  }
+  tabs.put(tab, false)
+  if fc.count(cdp.Page.Enable) != 1 {
+    t.Error("Page.enable not called")
+  }
+}
+
+func TestTabPoolIdleEvents(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  tab, e := tabs.get()
+  if e != nil {
+    t.Fatal(e)
+  }
+  // 异步调用的响应和页面加载事件超过Tab.C的缓冲区，放回池中后要被丢弃
+  for i := 0; i < 6; i++ {
+    callAsync(tab, cdp.Page.Navigate, cdp.Params{"url": "https://example.com/"})
+  }
+  tabs.put(tab, false)
+  time.Sleep(time.Millisecond * 200)
+  tab, e = tabs.get()
+  if e != nil {
+    t.Fatal(e)
+  }
+  v, ok := evaluate(tab, "document.URL")
+  if !ok || v != "https://example.com/" {
+    t.Errorf("expect url, got %q", v)
+  }
+  tabs.put(tab, !ok)
+  if n := atomic.LoadInt32(&fc.created); n != 1 {
+    t.Errorf("expect 1 tab, created %d", n)
+  }
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+  "bufio"
+  "encoding/base64"
+  "fmt"
+  "io"
+  "net"
+  "strconv"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+// 在本地端口上监听，每个连接由handle处理
+func serveTCP(t *testing.T, handle func(net.Conn)) net.Listener {
+  l, e := net.Listen("tcp", "127.0.0.1:0")
+  if e != nil {
+    t.Fatal(e)
+  }
+  go func() {
+    for {
+      c, e := l.Accept()
+      if e != nil {
+        return
+      }
+      go func() {
+        defer c.Close()
+        handle(c)
+      }()
+    }
+  }()
+  return l
+}
+
+// 进程内的假beanstalkd，实现了Runner用到的命令，
+// 不处理TTR超时，job的内容保存的是客户端发送的原始数据（base64）
+type fakeBeanstalkd struct {
+  l net.Listener
+
+  mu   sync.Mutex
+  seq  int
+  jobs map[string]*fakeBeanstalkJob
+}
+
+type fakeBeanstalkJob struct {
+  id    string
+  tube  string
+  body  string
+  pri   int
+  ttr   int
+  state string
+  ready time.Time
+
+  reserves, releases, buries, timeouts int
+}
+
+func newFakeBeanstalkd(t *testing.T) *fakeBeanstalkd {
+  fb := &fakeBeanstalkd{jobs: make(map[string]*fakeBeanstalkJob)}
+  fb.l = serveTCP(t, fb.handle)
+  return fb
+}
+
+func (fb *fakeBeanstalkd) port() int {
+  return fb.l.Addr().(*net.TCPAddr).Port
+}
+
+func (fb *fakeBeanstalkd) close() {
+  fb.l.Close()
+}
+
+// 直接向tube中添加job（与客户端一样用base64编码）
+func (fb *fakeBeanstalkd) put(tube string, data []byte) string {
+  fb.mu.Lock()
+  defer fb.mu.Unlock()
+  return fb.insert(tube, base64.RawStdEncoding.EncodeToString(data), 0, 0, 60)
+}
+
+func (fb *fakeBeanstalkd) insert(tube, body string, pri, delay, ttr int) string {
+  fb.seq++
+  id := strconv.Itoa(fb.seq)
+  fb.jobs[id] = &fakeBeanstalkJob{id: id, tube: tube, body: body, pri: pri, ttr: ttr, state: "ready", ready: time.Now().Add(time.Second * time.Duration(delay))}
+  return id
+}
+
+// tube中所有job的内容（按ID顺序）
+func (fb *fakeBeanstalkd) bodies(tube string) [][]byte {
+  fb.mu.Lock()
+  defer fb.mu.Unlock()
+  ret := make([][]byte, 0, 2)
+  for i := 1; i <= fb.seq; i++ {
+    if j, ok := fb.jobs[strconv.Itoa(i)]; ok && j.tube == tube {
+      data, _ := base64.RawStdEncoding.DecodeString(j.body)
+      ret = append(ret, data)
+    }
+  }
+  return ret
+}
+
+func (fb *fakeBeanstalkd) job(id string) *fakeBeanstalkJob {
+  fb.mu.Lock()
+  defer fb.mu.Unlock()
+  if j, ok := fb.jobs[id]; ok {
+    c := *j
+    return &c
+  }
+  return nil
+}
+
+func (fb *fakeBeanstalkd) reserve(watched map[string]bool) *fakeBeanstalkJob {
+  fb.mu.Lock()
+  defer fb.mu.Unlock()
+  now := time.Now()
+  for i := 1; i <= fb.seq; i++ {
+    j, ok := fb.jobs[strconv.Itoa(i)]
+    if !ok || !watched[j.tube] || j.state != "ready" || j.ready.After(now) {
+      continue
+    }
+    j.state = "reserved"
+    j.reserves++
+    return j
+  }
+  return nil
+}
+
+func (fb *fakeBeanstalkd) handle(c net.Conn) {
+  r := bufio.NewReader(c)
+  used := "default"
+  watched := map[string]bool{"default": true}
+  for {
+    line, e := r.ReadString('\n')
+    if e != nil {
+      return
+    }
+    args := strings.Fields(line)
+    if len(args) == 0 {
+      continue
+    }
+    var resp string
+    switch args[0] {
+    case "use":
+      used = args[1]
+      resp = "USING " + used + "\r\n"
+
+    case "watch":
+      watched[args[1]] = true
+      resp = fmt.Sprintf("WATCHING %d\r\n", len(watched))
+
+    case "ignore":
+      if len(watched) == 1 && watched[args[1]] {
+        resp = "NOT_IGNORED\r\n"
+      } else {
+        delete(watched, args[1])
+        resp = fmt.Sprintf("WATCHING %d\r\n", len(watched))
+      }
+
+    case "put":
+      pri, _ := strconv.Atoi(args[1])
+      delay, _ := strconv.Atoi(args[2])
+      ttr, _ := strconv.Atoi(args[3])
+      n, _ := strconv.Atoi(args[4])
+      body := make([]byte, n+2)
+      if _, e := io.ReadFull(r, body); e != nil {
+        return
+      }
+      fb.mu.Lock()
+      id := fb.insert(used, string(body[:n]), pri, delay, ttr)
+      fb.mu.Unlock()
+      resp = "INSERTED " + id + "\r\n"
+
+    case "reserve-with-timeout":
+      timeout, _ := strconv.Atoi(args[1])
+      deadline := time.Now().Add(time.Second * time.Duration(timeout))
+      j := fb.reserve(watched)
+      for j == nil && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond * 10)
+        j = fb.reserve(watched)
+      }
+      if j == nil {
+        resp = "TIMED_OUT\r\n"
+      } else {
+        resp = fmt.Sprintf("RESERVED %s %d\r\n%s\r\n", j.id, len(j.body), j.body)
+      }
+
+    case "delete", "release", "bury", "touch", "stats-job":
+      resp = fb.command(args)
+
+    case "quit":
+      return
+
+    default:
+      resp = "UNKNOWN_COMMAND\r\n"
+    }
+    if _, e := c.Write([]byte(resp)); e != nil {
+      return
+    }
+  }
+}
+
+// 操作指定ID的job的命令
+func (fb *fakeBeanstalkd) command(args []string) string {
+  fb.mu.Lock()
+  defer fb.mu.Unlock()
+  j, ok := fb.jobs[args[1]]
+  if !ok || (args[0] != "delete" && args[0] != "stats-job" && j.state != "reserved") {
+    return "NOT_FOUND\r\n"
+  }
+  switch args[0] {
+  case "delete":
+    delete(fb.jobs, j.id)
+    return "DELETED\r\n"
+  case "release":
+    j.pri, _ = strconv.Atoi(args[2])
+    delay, _ := strconv.Atoi(args[3])
+    j.state = "ready"
+    j.ready = time.Now().Add(time.Second * time.Duration(delay))
+    j.releases++
+    return "RELEASED\r\n"
+  case "bury":
+    j.pri, _ = strconv.Atoi(args[2])
+    j.state = "buried"
+    j.buries++
+    return "BURIED\r\n"
+  case "touch":
+    return "TOUCHED\r\n"
+  }
+  stats := fmt.Sprintf("---\nid: %s\ntube: %s\nstate: %s\npri: %d\nttr: %d\nreserves: %d\ntimeouts: %d\nreleases: %d\nburies: %d\n",
+    j.id, j.tube, j.state, j.pri, j.ttr, j.reserves, j.timeouts, j.releases, j.buries)
+  return fmt.Sprintf("OK %d\r\n%s\r\n", len(stats), stats)
+}
+
+// 进程内的假Redis，只实现了Stream队列用到的命令，
+// entry的ID是"1-<序号>"，不支持多个Stream共用序号以外的ID格式
+type fakeRedis struct {
+  l net.Listener
+
+  mu      sync.Mutex
+  streams map[string]*fakeStream
+}
+
+type fakeStream struct {
+  // 删除的entry为nil，保证下标就是序号-1
+  entries [][]string
+  groups  map[string]*fakeGroup
+}
+
+type fakeGroup struct {
+  // 已经投递的entry数量
+  last    int
+  pending map[int]*fakePending
+}
+
+type fakePending struct {
+  consumer  string
+  delivered time.Time
+  count     int
+}
+
+type respStatus string
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+  fr := &fakeRedis{streams: make(map[string]*fakeStream)}
+  fr.l = serveTCP(t, fr.handle)
+  return fr
+}
+
+func (fr *fakeRedis) addr() string {
+  return fr.l.Addr().String()
+}
+
+func (fr *fakeRedis) close() {
+  fr.l.Close()
+}
+
+func (fr *fakeRedis) stream(name string) *fakeStream {
+  s, ok := fr.streams[name]
+  if !ok {
+    s = &fakeStream{groups: make(map[string]*fakeGroup)}
+    fr.streams[name] = s
+  }
+  return s
+}
+
+func (fr *fakeRedis) add(name string, fields ...string) string {
+  fr.mu.Lock()
+  defer fr.mu.Unlock()
+  s := fr.stream(name)
+  s.entries = append(s.entries, fields)
+  return fmt.Sprintf("1-%d", len(s.entries))
+}
+
+// Stream中所有entry的data字段
+func (fr *fakeRedis) values(name string) [][]byte {
+  fr.mu.Lock()
+  defer fr.mu.Unlock()
+  ret := make([][]byte, 0, 2)
+  for _, fields := range fr.stream(name).entries {
+    for i := 0; i+1 < len(fields); i += 2 {
+      if fields[i] == "data" {
+        ret = append(ret, []byte(fields[i+1]))
+      }
+    }
+  }
+  return ret
+}
+
+func fakeEntryID(n int) string {
+  return fmt.Sprintf("1-%d", n+1)
+}
+
+func parseFakeEntryID(id string) int {
+  n, _ := strconv.Atoi(strings.TrimPrefix(id, "1-"))
+  return n - 1
+}
+
+func (s *fakeStream) entry(n int) interface{} {
+  fields := make([]interface{}, len(s.entries[n]))
+  for i, f := range s.entries[n] {
+    fields[i] = f
+  }
+  return []interface{}{fakeEntryID(n), fields}
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+  line, e := r.ReadString('\n')
+  if e != nil {
+    return nil, e
+  }
+  n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+  args := make([]string, n)
+  for i := range args {
+    line, e = r.ReadString('\n')
+    if e != nil {
+      return nil, e
+    }
+    l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+    data := make([]byte, l+2)
+    if _, e = io.ReadFull(r, data); e != nil {
+      return nil, e
+    }
+    args[i] = string(data[:l])
+  }
+  return args, nil
+}
+
+func writeRESP(w *bufio.Writer, v interface{}) {
+  switch v := v.(type) {
+  case nil:
+    w.WriteString("*-1\r\n")
+  case respStatus:
+    w.WriteString("+" + string(v) + "\r\n")
+  case respError:
+    w.WriteString("-" + string(v) + "\r\n")
+  case int:
+    fmt.Fprintf(w, ":%d\r\n", v)
+  case string:
+    fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+  case []interface{}:
+    fmt.Fprintf(w, "*%d\r\n", len(v))
+    for _, e := range v {
+      writeRESP(w, e)
+    }
+  }
+}
+
+func (fr *fakeRedis) handle(c net.Conn) {
+  r, w := bufio.NewReader(c), bufio.NewWriter(c)
+  for {
+    args, e := readRESPCommand(r)
+    if e != nil {
+      return
+    }
+    var v interface{}
+    if strings.ToUpper(args[0]) == "XREADGROUP" {
+      v = fr.xreadgroup(args)
+    } else {
+      fr.mu.Lock()
+      v = fr.command(args)
+      fr.mu.Unlock()
+    }
+    writeRESP(w, v)
+    if w.Flush() != nil {
+      return
+    }
+  }
+}
+
+func (fr *fakeRedis) command(args []string) interface{} {
+  switch strings.ToUpper(args[0]) {
+  case "PING", "AUTH", "SELECT":
+    return respStatus("OK")
+
+  case "XGROUP":
+    s := fr.stream(args[2])
+    if _, ok := s.groups[args[3]]; ok {
+      return respError("BUSYGROUP Consumer Group name already exists")
+    }
+    g := &fakeGroup{pending: make(map[int]*fakePending)}
+    if args[4] == "$" {
+      g.last = len(s.entries)
+    }
+    s.groups[args[3]] = g
+    return respStatus("OK")
+
+  case "XADD":
+    s := fr.stream(args[1])
+    s.entries = append(s.entries, args[3:])
+    return fakeEntryID(len(s.entries) - 1)
+
+  case "XACK":
+    g := fr.stream(args[1]).groups[args[2]]
+    n := 0
+    for _, id := range args[3:] {
+      if _, ok := g.pending[parseFakeEntryID(id)]; ok {
+        delete(g.pending, parseFakeEntryID(id))
+        n++
+      }
+    }
+    return n
+
+  case "XDEL":
+    s := fr.stream(args[1])
+    n := 0
+    for _, id := range args[2:] {
+      if i := parseFakeEntryID(id); i >= 0 && i < len(s.entries) && s.entries[i] != nil {
+        s.entries[i] = nil
+        n++
+      }
+    }
+    return n
+
+  case "XAUTOCLAIM":
+    // XAUTOCLAIM stream group consumer min-idle start COUNT n
+    s := fr.stream(args[1])
+    g := s.groups[args[2]]
+    minIdle, _ := strconv.Atoi(args[4])
+    claimed := make([]interface{}, 0, 1)
+    for n := 0; n < len(s.entries) && len(claimed) == 0; n++ {
+      p, ok := g.pending[n]
+      if !ok || time.Since(p.delivered) < time.Duration(minIdle)*time.Millisecond || s.entries[n] == nil {
+        continue
+      }
+      p.consumer, p.delivered = args[3], time.Now()
+      p.count++
+      claimed = append(claimed, s.entry(n))
+    }
+    return []interface{}{"0-0", claimed, []interface{}{}}
+
+  case "XPENDING":
+    // XPENDING stream group start end count consumer，只支持start和end相同
+    g := fr.stream(args[1]).groups[args[2]]
+    p, ok := g.pending[parseFakeEntryID(args[3])]
+    if !ok || (len(args) > 6 && p.consumer != args[6]) {
+      return []interface{}{}
+    }
+    idle := int(time.Since(p.delivered) / time.Millisecond)
+    return []interface{}{[]interface{}{args[3], p.consumer, idle, p.count}}
+
+  case "XCLAIM":
+    // XCLAIM stream group consumer min-idle id IDLE ms JUSTID
+    g := fr.stream(args[1]).groups[args[2]]
+    p, ok := g.pending[parseFakeEntryID(args[5])]
+    if !ok {
+      return []interface{}{}
+    }
+    idle, _ := strconv.Atoi(args[7])
+    p.consumer, p.delivered = args[3], time.Now().Add(-time.Duration(idle)*time.Millisecond)
+    return []interface{}{args[5]}
+  }
+  return respError("ERR unknown command '" + args[0] + "'")
+}
+
+// XREADGROUP GROUP group consumer COUNT n [BLOCK ms] STREAMS stream >
+func (fr *fakeRedis) xreadgroup(args []string) interface{} {
+  var block time.Duration
+  if strings.ToUpper(args[6]) == "BLOCK" {
+    ms, _ := strconv.Atoi(args[7])
+    block = time.Duration(ms) * time.Millisecond
+  }
+  name := args[len(args)-2]
+  deadline := time.Now().Add(block)
+  for {
+    fr.mu.Lock()
+    s := fr.stream(name)
+    g, ok := s.groups[args[2]]
+    if !ok {
+      fr.mu.Unlock()
+      return respError("NOGROUP No such consumer group")
+    }
+    for g.last < len(s.entries) {
+      n := g.last
+      g.last++
+      if s.entries[n] == nil {
+        continue
+      }
+      g.pending[n] = &fakePending{consumer: args[3], delivered: time.Now(), count: 1}
+      entry := s.entry(n)
+      fr.mu.Unlock()
+      return []interface{}{[]interface{}{name, []interface{}{entry}}}
+    }
+    fr.mu.Unlock()
+    if !time.Now().Before(deadline) {
+      return nil
+    }
+    time.Sleep(time.Millisecond * 10)
+  }
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io/ioutil"
+  "net"
+  "net/http"
+  "os"
+  "path/filepath"
+  "reflect"
+  "sort"
+  "strings"
+)
+
+// 离线测试规则用的页面快照，放在规则目录下的fixtures/<规则名>/中，
+// 每个用例是一对文件：<用例名>.html（页面快照，已去掉script）和<用例名>.json（fixture），
+// 快照应该由capture命令从线上页面生成，生成后需要人工核对json中的期望值，
+// 注意：目前自带的fixture都是手写的精简页面（只包含规则用到的元素），
+// 只能发现规则脚本本身的错误（语法、解析），不能说明规则仍然适用于线上页面，
+// 应该逐步用capture生成的快照替换（见fixtures/README.md）
+type fixture struct {
+  // 页面的原始链接（标准URL），用于匹配规则和提取ID
+  URL string `json:"url"`
+
+  // 期望抓到的商品字段（与Product的JSON字段一致），只比较列出的字段
+  Product map[string]interface{} `json:"product"`
+
+  // 快照文件的路径
+  file string
+}
+
+// 生成fixture时不记录的字段（每次抓取都会变化或者与规则无关）
+var fixtureIgnoredFields = []string{"_id", "url", "short_url", "update_time"}
+
+// 去掉脚本后的页面快照，
+// 去掉脚本是为了离线加载时页面保持抓取时的状态（不会再次渲染、跳转或请求接口）
+const snapshotExpression = "{let doc666 = document.documentElement.cloneNode(true);Array.prototype.slice.call(doc666.querySelectorAll('script, noscript, iframe')).forEach(function (e) {e.remove();});'<!DOCTYPE html>\\n' + doc666.outerHTML;}"
+
+func fixtureDir(rulesDir, name string) string {
+  return filepath.Join(rulesDir, "fixtures", name)
+}
+
+// 加载规则目录下所有的fixture
+func loadFixtures(rulesDir string) ([]*fixture, error) {
+  files, e := filepath.Glob(filepath.Join(rulesDir, "fixtures", "*", "*.json"))
+  if e != nil {
+    return nil, e
+  }
+  sort.Strings(files)
+  ret := make([]*fixture, 0, len(files))
+  for _, file := range files {
+    data, e := ioutil.ReadFile(file)
+    if e != nil {
+      return nil, e
+    }
+    f := &fixture{}
+    e = json.Unmarshal(data, f)
+    if e != nil {
+      return nil, fmt.Errorf("%s: %s", file, e)
+    }
+    f.file = strings.TrimSuffix(file, ".json") + ".html"
+    ret = append(ret, f)
+  }
+  return ret, nil
+}
+
+// 保存fixture（覆盖同名用例）
+func saveFixture(rulesDir, ruleName, name, page string, p *Product) (string, error) {
+  dir := fixtureDir(rulesDir, ruleName)
+  e := os.MkdirAll(dir, 0755)
+  if e != nil {
+    return "", e
+  }
+  data, _ := json.Marshal(p)
+  m := make(map[string]interface{}, 16)
+  json.Unmarshal(data, &m)
+  for _, k := range fixtureIgnoredFields {
+    delete(m, k)
+  }
+  data, _ = json.MarshalIndent(&fixture{URL: p.URL, Product: m}, "", "  ")
+  file := filepath.Join(dir, name)
+  e = ioutil.WriteFile(file+".html", []byte(page), 0644)
+  if e != nil {
+    return "", e
+  }
+  return file + ".json", ioutil.WriteFile(file+".json", append(data, '\n'), 0644)
+}
+
+// 在本地启动一个只提供快照页面的Server，返回页面的地址和关闭Server的函数
+func serveFixture(f *fixture) (string, func(), error) {
+  page, e := ioutil.ReadFile(f.file)
+  if e != nil {
+    return "", nil, e
+  }
+  l, e := net.Listen("tcp", "127.0.0.1:0")
+  if e != nil {
+    return "", nil, e
+  }
+  srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if r.URL.Path != "/" {
+      http.NotFound(w, r)
+      return
+    }
+    w.Header().Set("Content-Type", "text/html; charset=utf-8")
+    w.Write(page)
+  })}
+  go srv.Serve(l)
+  return "http://" + l.Addr().String() + "/", func() { srv.Close() }, nil
+}
+
+// 离线执行fixture：在Chrome中打开本地的快照页面，
+// 按照fixture.URL对应的规则执行脚本（与抓取线上页面的extract/handle相同），返回抓到的商品
+func runFixture(rs ruleSet, f *fixture) (*Product, error) {
+  rule := rs.findRuleByURL(f.URL)
+  if rule == nil {
+    return nil, fmt.Errorf("no rule matches %s", f.URL)
+  }
+  addr, stop, e := serveFixture(f)
+  if e != nil {
+    return nil, e
+  }
+  defer stop()
+  tab, e := tabs.get()
+  if e != nil {
+    return nil, e
+  }
+  r := newCrawlResult(f.URL)
+  ok := navigate(tab, addr)
+  if ok {
+    ok = extract(tab, f.URL, rule, r)
+  }
+  tabs.put(tab, !ok)
+  if !ok {
+    return nil, fmt.Errorf("tab closed while running %s", f.file)
+  }
+  return r.Product, nil
+}
+
+// 比较抓到的商品和fixture中期望的字段，返回不一致的字段
+func (f *fixture) diff(p *Product) []string {
+  data, _ := json.Marshal(p)
+  actual := make(map[string]interface{}, 16)
+  json.Unmarshal(data, &actual)
+  keys := make([]string, 0, len(f.Product))
+  for k := range f.Product {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  ret := make([]string, 0, 2)
+  for _, k := range keys {
+    if !reflect.DeepEqual(f.Product[k], actual[k]) {
+      ret = append(ret, fmt.Sprintf("%s: expect %v, got %v", k, f.Product[k], actual[k]))
+    }
+  }
+  return ret
+}
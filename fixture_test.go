@@ -0,0 +1,56 @@
+package main
+
+import (
+  "os"
+  "testing"
+)
+
+// 不需要Chrome：检查fixture文件完整并且都有对应的规则
+func TestFixtureFiles(t *testing.T) {
+  rules, _ := loadRules("rules")
+  rs := ruleSet(rules)
+  fixtures, e := loadFixtures("rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  if len(fixtures) == 0 {
+    t.Fatal("no fixtures")
+  }
+  for _, f := range fixtures {
+    if _, e := os.Stat(f.file); e != nil {
+      t.Error(e)
+    }
+    r := rs.findRuleByURL(f.URL)
+    if r == nil {
+      t.Errorf("%s: no rule matches %s", f.file, f.URL)
+      continue
+    }
+    if id, ok := f.Product["id"]; ok && id != matchIDFromRule(f.URL, r) {
+      t.Errorf("%s: id %v does not match url", f.file, id)
+    }
+  }
+}
+
+// 在Chrome中离线执行所有fixture，检查规则的提取结果
+func TestFixtures(t *testing.T) {
+  requireChrome(t)
+  if e := LoadRules(Conf.Task.Rules); e != nil {
+    t.Fatal(e)
+  }
+  initChrome()
+  defer closeChrome()
+  fixtures, e := loadFixtures(Conf.Task.Rules)
+  if e != nil {
+    t.Fatal(e)
+  }
+  for _, f := range fixtures {
+    p, e := runFixture(currentRules(), f)
+    if e != nil {
+      t.Errorf("%s: %s", f.file, e)
+      continue
+    }
+    for _, d := range f.diff(p) {
+      t.Errorf("%s: %s", f.file, d)
+    }
+  }
+}
@@ -4,6 +4,7 @@ require (
 	github.com/go-sql-driver/mysql v1.4.0
 	github.com/kwf2030/commons v1.0.2
 	github.com/rs/zerolog v1.9.1
+	go.etcd.io/bbolt v1.3.1-etcd.8
 	google.golang.org/appengine v1.2.0 // indirect
 	gopkg.in/yaml.v2 v2.2.1
 )
@@ -0,0 +1,180 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode"
+  "unicode/utf8"
+)
+
+// 默认的数字格式，小数点为.，千位分隔符为,
+var defaultLocale = mustLocale(&locale{})
+
+// 数字后面的单位
+var numberUnits = map[string]float64{
+  "千": 1e3,
+  "k": 1e3,
+  "K": 1e3,
+  "万": 1e4,
+  "w": 1e4,
+  "W": 1e4,
+  "亿": 1e8,
+}
+
+// 价格区间的分隔符
+var rangeSeparators = map[string]bool{
+  "-": true,
+  "~": true,
+  "–": true,
+  "—": true,
+  "至": true,
+  "到": true,
+}
+
+// 规则中的数字格式，用于解析价格、库存、销量和评论数，
+// 页面上取到的值不需要在JS中处理，如"￥ 2,599 - ￥ 3,299（税込）"、"1.234,56 €"、"1.4万+"、"¥99起"
+type locale struct {
+  // 小数点，默认为.
+  Decimal string `yaml:"decimal"`
+
+  // 千位分隔符，默认为,（空格和'总是作为千位分隔符，如1 234,56、1'234.56）
+  Thousands string `yaml:"thousands"`
+
+  regex *regexp.Regexp
+}
+
+func mustLocale(l *locale) *locale {
+  e := l.compile()
+  if e != nil {
+    panic(e)
+  }
+  return l
+}
+
+// 检查并生成匹配数字的正则，
+// 数字的整数部分可以按3位分组，分组的数字之间可以有空格，后面可以有单位（千、万、亿、k、w）
+func (l *locale) compile() error {
+  if l.Decimal == "" {
+    l.Decimal = "."
+  }
+  if l.Thousands == "" {
+    l.Thousands = ","
+  }
+  for _, v := range []string{l.Decimal, l.Thousands} {
+    r, n := utf8.DecodeRuneInString(v)
+    if n != len(v) || r == utf8.RuneError {
+      return fmt.Errorf("%q is not a single character", v)
+    }
+    if unicode.IsDigit(r) || unicode.IsLetter(r) || rangeSeparators[v] || (v == l.Decimal && unicode.IsSpace(r)) {
+      return fmt.Errorf("%q can not be used as separator", v)
+    }
+  }
+  if l.Decimal == l.Thousands {
+    return errors.New("decimal and thousands are the same")
+  }
+  sep := regexp.QuoteMeta(l.Thousands) + `' \x{a0}\x{202f}`
+  l.regex = regexp.MustCompile(fmt.Sprintf(`(\d+(?:[%s]\d{3})*(?:%s\d+)?)\s*([千万亿]|[kKwW]\b)?`, sep, regexp.QuoteMeta(l.Decimal)))
+  return nil
+}
+
+// 值中的数字，start和end是在全角转换后的字符串中的位置
+type number struct {
+  value float64
+  start int
+  end   int
+}
+
+// 找出值中最多n个数字，全角的数字和符号先转换为半角
+func (l *locale) numbers(value string, n int) (string, []*number) {
+  if l == nil || l.regex == nil {
+    l = defaultLocale
+  }
+  value = narrow(value)
+  ret := make([]*number, 0, n)
+  for _, m := range l.regex.FindAllStringSubmatchIndex(value, n) {
+    s := value[m[2]:m[3]]
+    s = strings.Map(func(r rune) rune {
+      switch {
+      case r >= '0' && r <= '9':
+        return r
+      case string(r) == l.Decimal:
+        return '.'
+      default:
+        return -1
+      }
+    }, s)
+    v, e := strconv.ParseFloat(s, 64)
+    if e != nil {
+      continue
+    }
+    if m[4] != -1 {
+      v *= numberUnits[value[m[4]:m[5]]]
+    }
+    ret = append(ret, &number{value: v, start: m[0], end: m[1]})
+  }
+  return value, ret
+}
+
+// 解析价格，
+// 如果是唯一价格（包括"99起"），返回的len(slice)是1，
+// 如果是区间（两个价格之间只有区间分隔符、空格、货币符号或单位），返回的len(slice)是2，
+// 没有价格时返回NoValue
+func (l *locale) parsePrice(value string) []float64 {
+  s, arr := l.numbers(value, 2)
+  switch {
+  case len(arr) == 0:
+    return []float64{NoValue}
+  case len(arr) == 2 && isRangeSeparator(s[arr[0].end:arr[1].start]):
+    return []float64{roundPrice(arr[0].value), roundPrice(arr[1].value)}
+  default:
+    return []float64{roundPrice(arr[0].value)}
+  }
+}
+
+// 解析数量（库存、销量和评论数），取第一个数字，如"1.4万+"、"1,000+"、"库存123件"，
+// 小数部分直接舍去（先保留两位小数，避免1.4万这样相乘的误差被舍成13999）
+func (l *locale) atoi(value string) int {
+  _, arr := l.numbers(value, 1)
+  if len(arr) == 0 {
+    return NoValue
+  }
+  return int(math.Trunc(roundPrice(arr[0].value)))
+}
+
+// 解析唯一价格，区间时取最低价
+func (l *locale) atof(value string) float64 {
+  return l.parsePrice(value)[0]
+}
+
+// 带单位的价格（如1.2万）相乘后可能有误差，保留两位小数
+func roundPrice(v float64) float64 {
+  return math.Round(v*100) / 100
+}
+
+// 去掉空格、货币符号和单位（如"元"、"EUR"）后只剩下一个区间分隔符
+func isRangeSeparator(s string) bool {
+  s = strings.Map(func(r rune) rune {
+    if unicode.IsSpace(r) || unicode.Is(unicode.Sc, r) || (unicode.IsLetter(r) && !rangeSeparators[string(r)]) {
+      return -1
+    }
+    return r
+  }, s)
+  return rangeSeparators[s]
+}
+
+// 全角字符（数字、符号和空格）转换为半角
+func narrow(s string) string {
+  return strings.Map(func(r rune) rune {
+    switch {
+    case r >= '！' && r <= '～':
+      return r - 0xfee0
+    case r == '　':
+      return ' '
+    }
+    return r
+  }, s)
+}
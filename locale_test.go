@@ -0,0 +1,130 @@
+package main
+
+import (
+  "reflect"
+  "testing"
+)
+
+var (
+  deLocale = mustLocale(&locale{Decimal: ",", Thousands: "."})
+  frLocale = mustLocale(&locale{Decimal: ",", Thousands: " "})
+)
+
+func TestParsePrice(t *testing.T) {
+  cases := []struct {
+    locale *locale
+    value  string
+    expect []float64
+  }{
+    {nil, "119.00", []float64{119}},
+    {nil, "1,299.00", []float64{1299}},
+    {nil, "1,234,567.89", []float64{1234567.89}},
+    {nil, "￥1,299.00", []float64{1299}},
+    {nil, "¥ 99", []float64{99}},
+    {nil, "$25.99", []float64{25.99}},
+    {nil, "£1,000", []float64{1000}},
+    {nil, "RMB 12.5", []float64{12.5}},
+    {nil, "12.5元", []float64{12.5}},
+    {nil, " \n 59.00 \t", []float64{59}},
+    {nil, "１，２９９．００", []float64{1299}},
+    {nil, "￥１２９９", []float64{1299}},
+    {nil, "1'299.50", []float64{1299.5}},
+    {nil, "99-199", []float64{99, 199}},
+    {nil, "99~199", []float64{99, 199}},
+    {nil, "99 - 199", []float64{99, 199}},
+    {nil, "¥99 - ¥199", []float64{99, 199}},
+    {nil, "99元-199元", []float64{99, 199}},
+    {nil, "99.00 ~ 199.00", []float64{99, 199}},
+    {nil, "99～199", []float64{99, 199}},
+    {nil, "99－199", []float64{99, 199}},
+    {nil, "$25.99 – $35.99", []float64{25.99, 35.99}},
+    {nil, "99至199", []float64{99, 199}},
+    {nil, "99 到 199", []float64{99, 199}},
+    {nil, "￥ 2,599 - ￥ 3,299（税込）", []float64{2599, 3299}},
+    {nil, "USD 10 - USD 20", []float64{10, 20}},
+    {nil, "¥99起", []float64{99}},
+    {nil, "99元起", []float64{99}},
+    {nil, "¥99 (3折)", []float64{99}},
+    {nil, "1.2万", []float64{12000}},
+    {nil, "1.2万-1.5万", []float64{12000, 15000}},
+    {nil, "0.57万", []float64{5700}},
+    {nil, "", []float64{NoValue}},
+    {nil, "暂无报价", []float64{NoValue}},
+    {nil, "¥", []float64{NoValue}},
+    {deLocale, "21,99 €", []float64{21.99}},
+    {deLocale, "1.234,56 €", []float64{1234.56}},
+    {deLocale, "EUR 21,99", []float64{21.99}},
+    {deLocale, "21,99 € - 29,99 €", []float64{21.99, 29.99}},
+    {deLocale, "1.234", []float64{1234}},
+    {deLocale, "1.234.567", []float64{1234567}},
+    {frLocale, "1 234,56 €", []float64{1234.56}},
+    {frLocale, "1 234,56 €", []float64{1234.56}},
+    {frLocale, "1 234,56 €", []float64{1234.56}},
+  }
+  for _, c := range cases {
+    if v := c.locale.parsePrice(c.value); !reflect.DeepEqual(v, c.expect) {
+      t.Errorf("%q: expect %v, got %v", c.value, c.expect, v)
+    }
+  }
+}
+
+func TestParseQuantity(t *testing.T) {
+  cases := []struct {
+    locale *locale
+    value  string
+    expect int
+  }{
+    {nil, "128", 128},
+    {nil, "1,212", 1212},
+    {nil, "1 234 +", 1234},
+    {nil, "1000+", 1000},
+    {nil, "1.4万", 14000},
+    {nil, "1.4万+", 14000},
+    {nil, "1.4 万+", 14000},
+    {nil, "10万+", 100000},
+    {nil, "0.57万", 5700},
+    {nil, "2千", 2000},
+    {nil, "3.5亿", 350000000},
+    {nil, "2.5k", 2500},
+    {nil, "10K+ bought in past month", 10000},
+    {nil, "1.2w+", 12000},
+    {nil, "5kg", 5},
+    {nil, "库存123件", 123},
+    {nil, "库存1,234件", 1234},
+    {nil, "仅剩3件", 3},
+    {nil, "1234人已购买", 1234},
+    {nil, "４５６", 456},
+    {nil, "12.6", 12},
+    {nil, "1.5件", 1},
+    {nil, "1.23456万", 12345},
+    {nil, "", NoValue},
+    {nil, "无货", NoValue},
+    {deLocale, "1.234", 1234},
+    {deLocale, "Nur noch 3 auf Lager", 3},
+    {deLocale, "1,5", 1},
+    {frLocale, "2 345 évaluations", 2345},
+  }
+  for _, c := range cases {
+    if v := c.locale.atoi(c.value); v != c.expect {
+      t.Errorf("%q: expect %d, got %d", c.value, c.expect, v)
+    }
+  }
+}
+
+func TestLocaleCompileError(t *testing.T) {
+  cases := []*locale{
+    {Decimal: ",", Thousands: ","},
+    {Decimal: ","},
+    {Decimal: "..", Thousands: ","},
+    {Decimal: "1"},
+    {Decimal: "a"},
+    {Decimal: " "},
+    {Thousands: "-"},
+    {Thousands: "~"},
+  }
+  for i, l := range cases {
+    if e := l.compile(); e == nil {
+      t.Errorf("case %d: expect error", i)
+    }
+  }
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+  "compress/gzip"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "regexp"
+  "sort"
+  "strconv"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 日志文件名，runner_<日期>.log，同一天超过大小后为runner_<日期>_1.log、runner_<日期>_2.log...
+var logNameRegex = regexp.MustCompile(`^runner_(\d{8})(?:_(\d+))?\.log(\.gz)?$`)
+
+// 按天和大小切分的日志文件，切分后的文件可以用gzip压缩，只保留最近keep个文件，
+// 写入和切分都在mu中进行，不会写入已经关闭的文件
+type rotateWriter struct {
+  dir      string
+  maxSize  int64
+  keep     int
+  compress bool
+  now      func() time.Time
+
+  mu   sync.Mutex
+  f    *os.File
+  day  string
+  seq  int
+  size int64
+
+  // 压缩和清理在后台进行，关闭时等待完成
+  wg sync.WaitGroup
+}
+
+// maxSize为0表示只按天切分，keep为0表示保留所有文件
+func newRotateWriter(dir string, maxSize int64, keep int, compress bool) (*rotateWriter, error) {
+  w := &rotateWriter{dir: dir, maxSize: maxSize, keep: keep, compress: compress, now: times.Now}
+  return w, w.openLatest()
+}
+
+// 打开当天的最后一个文件，并删除多余的文件
+func (w *rotateWriter) openLatest() error {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.day = w.now().Format(times.DateFormat3)
+  w.seq = w.start(w.day)
+  e := w.open()
+  if e == nil {
+    w.clean(w.f.Name())
+  }
+  return e
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  day := w.now().Format(times.DateFormat3)
+  if w.f == nil || day != w.day || (w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize) {
+    if e := w.rotate(day); e != nil {
+      return 0, e
+    }
+  }
+  n, e := w.f.Write(p)
+  w.size += int64(n)
+  return n, e
+}
+
+func (w *rotateWriter) Close() error {
+  w.mu.Lock()
+  var e error
+  if w.f != nil {
+    e = w.f.Close()
+    w.f = nil
+  }
+  w.mu.Unlock()
+  w.wg.Wait()
+  return e
+}
+
+func (w *rotateWriter) name(day string, seq int) string {
+  if seq == 0 {
+    return filepath.Join(w.dir, fmt.Sprintf("runner_%s.log", day))
+  }
+  return filepath.Join(w.dir, fmt.Sprintf("runner_%s_%d.log", day, seq))
+}
+
+// 关闭当前文件并打开下一个，关闭的文件在后台压缩和清理
+func (w *rotateWriter) rotate(day string) error {
+  old := ""
+  if w.f != nil {
+    old = w.f.Name()
+    w.f.Close()
+    w.f = nil
+  }
+  switch {
+  case day != w.day:
+    w.day, w.seq = day, w.start(day)
+  case old != "":
+    w.seq++
+  }
+  e := w.open()
+  if old != "" {
+    w.wg.Add(1)
+    go func(current string) {
+      defer w.wg.Done()
+      if w.compress {
+        if e := gzipFile(old); e != nil {
+          logger.Error().Err(e).Msgf("ERR: Gzip, file=%s", old)
+        }
+      }
+      w.clean(current)
+    }(w.name(w.day, w.seq))
+  }
+  return e
+}
+
+// 打开当前序号的文件（追加），超过大小时打开下一个
+func (w *rotateWriter) open() error {
+  for {
+    f, e := os.OpenFile(w.name(w.day, w.seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    if e != nil {
+      return e
+    }
+    info, e := f.Stat()
+    if e != nil {
+      f.Close()
+      return e
+    }
+    if w.maxSize > 0 && info.Size() >= w.maxSize {
+      f.Close()
+      w.seq++
+      continue
+    }
+    w.f, w.size = f, info.Size()
+    return nil
+  }
+}
+
+// 启动或跨天时从day的最后一个文件继续写，已经压缩的从下一个开始
+func (w *rotateWriter) start(day string) int {
+  seq, gz := w.last(day)
+  if gz {
+    seq++
+  }
+  return seq
+}
+
+// day的最后一个文件的序号，以及是否已经压缩
+func (w *rotateWriter) last(day string) (int, bool) {
+  seq, gz := 0, false
+  for _, v := range w.files() {
+    if v.day == day && (v.seq > seq || (v.seq == seq && v.gz)) {
+      seq, gz = v.seq, v.gz
+    }
+  }
+  return seq, gz
+}
+
+type logFileInfo struct {
+  name string
+  day  string
+  seq  int
+  gz   bool
+}
+
+// 目录下所有的日志文件，按日期和序号排序
+func (w *rotateWriter) files() []*logFileInfo {
+  arr, _ := ioutil.ReadDir(w.dir)
+  ret := make([]*logFileInfo, 0, len(arr))
+  for _, v := range arr {
+    m := logNameRegex.FindStringSubmatch(v.Name())
+    if v.IsDir() || m == nil {
+      continue
+    }
+    seq, _ := strconv.Atoi(m[2])
+    ret = append(ret, &logFileInfo{name: v.Name(), day: m[1], seq: seq, gz: m[3] != ""})
+  }
+  sort.Slice(ret, func(i, j int) bool {
+    if ret[i].day != ret[j].day {
+      return ret[i].day < ret[j].day
+    }
+    return ret[i].seq < ret[j].seq
+  })
+  return ret
+}
+
+// 删除最旧的文件，只保留keep个（包括正在写入的current），
+// 同一个文件压缩期间可能同时有.log和.log.gz，算一个
+func (w *rotateWriter) clean(current string) {
+  if w.keep <= 0 {
+    return
+  }
+  files := w.files()
+  keys := make([]string, 0, len(files))
+  names := make(map[string][]string, len(files))
+  for _, v := range files {
+    k := fmt.Sprintf("%s_%d", v.day, v.seq)
+    if names[k] == nil {
+      keys = append(keys, k)
+    }
+    names[k] = append(names[k], v.name)
+  }
+  for i := 0; i < len(keys)-w.keep; i++ {
+    for _, name := range names[keys[i]] {
+      if file := filepath.Join(w.dir, name); file != current {
+        os.Remove(file)
+      }
+    }
+  }
+}
+
+// 压缩为file.gz，成功后删除file
+func gzipFile(file string) error {
+  src, e := os.Open(file)
+  if e != nil {
+    return e
+  }
+  defer src.Close()
+  dst, e := os.OpenFile(file+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+  if e != nil {
+    return e
+  }
+  gw := gzip.NewWriter(dst)
+  _, e = io.Copy(gw, src)
+  if e2 := gw.Close(); e == nil {
+    e = e2
+  }
+  if e2 := dst.Close(); e == nil {
+    e = e2
+  }
+  if e != nil {
+    os.Remove(file + ".gz")
+    return e
+  }
+  src.Close()
+  return os.Remove(file)
+}
+
+// 输出到stdout时不需要关闭
+type nopWriteCloser struct {
+  io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+  return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+)
+
+func logNames(dir string) []string {
+  arr, _ := ioutil.ReadDir(dir)
+  ret := make([]string, 0, len(arr))
+  for _, v := range arr {
+    ret = append(ret, v.Name())
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+func TestRotateWriter(t *testing.T) {
+  dir, e := ioutil.TempDir("", "log")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  day := time.Date(2020, 1, 1, 23, 0, 0, 0, time.Local)
+  ioutil.WriteFile(filepath.Join(dir, "runner_20200101.log"), []byte("old\n"), 0644)
+
+  now := func() time.Time {
+    return day
+  }
+  w := &rotateWriter{dir: dir, maxSize: 10, keep: 3, compress: true, now: now}
+  if e := w.openLatest(); e != nil {
+    t.Fatal(e)
+  }
+  // 启动时追加到当天已有的文件，超过10字节后切分
+  w.Write([]byte("1234\n"))
+  w.Write([]byte("5678\n"))
+  day = day.Add(time.Hour * 2)
+  w.Write([]byte("next\n"))
+  w.Close()
+  names := strings.Join(logNames(dir), ",")
+  if names != "runner_20200101.log.gz,runner_20200101_1.log.gz,runner_20200102.log" {
+    t.Fatalf("unexpected files %s", names)
+  }
+  data, _ := readDump(filepath.Join(dir, "runner_20200101.log.gz"))
+  if string(data) != "old\n1234\n" {
+    t.Errorf("unexpected content %q", data)
+  }
+
+  // 重新打开后继续写当天的文件，只保留3个
+  w = &rotateWriter{dir: dir, maxSize: 10, keep: 3, compress: true, now: now}
+  if e := w.openLatest(); e != nil {
+    t.Fatal(e)
+  }
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      w.Write([]byte("abcdefgh\n"))
+    }()
+  }
+  wg.Wait()
+  w.Close()
+  names = strings.Join(logNames(dir), ",")
+  if strings.Contains(names, "20200101") || len(logNames(dir)) > 4 {
+    t.Errorf("unexpected files %s", names)
+  }
+  data, _ = ioutil.ReadFile(filepath.Join(dir, "runner_20200102_4.log"))
+  if string(data) != "abcdefgh\n" {
+    t.Errorf("unexpected content %q, files %s", data, names)
+  }
+}
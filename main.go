@@ -4,14 +4,17 @@ import (
   "encoding/json"
   "errors"
   "fmt"
-  "io/ioutil"
+  "html"
+  "io"
   "os"
   "os/signal"
   "runtime"
   "strings"
+  "sync"
+  "sync/atomic"
+  "syscall"
   "time"
 
-  "github.com/kwf2030/commons/beanstalk"
   "github.com/kwf2030/commons/boltdb"
   "github.com/kwf2030/commons/cdp"
   "github.com/kwf2030/commons/httputil"
@@ -26,23 +29,43 @@ var (
   // 每个商品在抓之前会先查询是否在指定的时间段内（例如6小时内）已经抓过
   bucketProducts = []byte("product")
 
-  // 定时取任务
-  loopChan = make(chan struct{})
+  // 定时取任务，缓冲为1，正在处理任务时再次触发的会在处理完后执行（多次触发只执行一次）
+  loopChan = make(chan struct{}, 1)
 
-  // 日志文件，以天为单位，每天自动创建新的文件
-  logFile *os.File
-  logger  *zerolog.Logger
+  // 下次取任务的定时器
+  pollTimer *time.Timer
+  pollMu    sync.Mutex
+
+  // Runner关闭时关闭，不再取任务和启动新的抓取
+  stopChan = make(chan struct{})
+
+  // 处理任务期间持有，关闭时等待当前任务处理完
+  working sync.Mutex
+
+  // 日志的输出，输出到文件时按天和大小切分（rotateWriter），logger初始化后不再替换
+  logOutput io.WriteCloser
+  logger    *zerolog.Logger
 
   store  *boltdb.Store
   chrome cdp.Chrome
 
-  // Beanstalk的任务ID，抓完之后要删除
-  jobID string
+  // 当前处理的任务，抓完之后要删除
+  current *queueJob
 
-  conn *beanstalk.Conn
+  // 每一轮重试之间的间隔
+  retryInterval = time.Second * 10
+
+  // 短链接服务
+  shortener = httputil.ShortenURL
+  shortenMu sync.Mutex
 )
 
 func main() {
+  if len(os.Args) > 1 {
+    if cmd, ok := commands[os.Args[1]]; ok {
+      os.Exit(cmd(os.Args[2:]))
+    }
+  }
   file := "conf.yaml"
   if len(os.Args) == 2 {
     file = os.Args[1]
@@ -53,43 +76,116 @@ func main() {
   }
   e = LoadRules(Conf.Task.Rules)
   if e != nil {
-    panic(e)
+    fmt.Fprintln(os.Stderr, e)
+    os.Exit(1)
   }
 
   initLogger()
-  defer logFile.Close()
+  defer logOutput.Close()
+  go dumpCleanLoop()
   logger.Info().Msg("Hiprice Runner " + Version)
+  go watchRules()
 
   initStore()
   defer store.Close()
+  go evictLoop()
 
   initChrome()
-  defer func() {
-    tab, e := chrome.NewTab()
-    if e == nil {
-      tab.CallAsync(cdp.Browser.Close)
+  defer closeChrome()
+
+  initQueue()
+  defer queue.close()
+
+  if Conf.Admin.Addr != "" {
+    addr, e := serveAdmin(Conf.Admin.Addr, Conf.Admin.Token)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Admin")
+    } else {
+      logger.Info().Msgf("admin listening on %s", addr)
     }
-  }()
+  }
 
-  initBeanstalk()
-  defer conn.Quit()
+  if Conf.Metrics.Addr != "" {
+    addr, e := serveMetrics(Conf.Metrics.Addr)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Metrics")
+    } else {
+      logger.Info().Msgf("metrics listening on %s", addr)
+    }
+  }
 
   go run()
   loopChan <- struct{}{}
 
   s := make(chan os.Signal, 1)
-  signal.Notify(s, os.Interrupt)
-  <-s
+  signal.Notify(s, os.Interrupt, syscall.SIGTERM)
+  logger.Info().Msgf("%s received, shutting down", <-s)
+  if !shutdown(time.Second * time.Duration(Conf.Task.ShutdownTimeout)) {
+    // 不执行defer（关闭store和队列），没完成的任务超过TTR后会被其他Runner取走
+    logOutput.Close()
+    os.Exit(1)
+  }
+}
+
+// 关闭Runner：不再取任务，等待正在执行的抓取完成（最多等待timeout），
+// 当前任务提交已经抓到的结果，没抓的部分放回队列，最后关闭所有标签页，
+// 之后由main中的defer依次关闭队列、Chrome和store，
+// 返回false表示任务还没处理完（仍然在使用store和队列），这时不能关闭它们
+func shutdown(timeout time.Duration) bool {
+  close(stopChan)
+  done := make(chan struct{})
+  go func() {
+    working.Lock()
+    working.Unlock()
+    close(done)
+  }()
+  select {
+  case <-done:
+  case <-time.After(timeout):
+    // 超时后中断正在执行的抓取，最多再等待同样的时间让任务提交结果
+    logger.Warn().Msg("shutdown timeout, interrupt crawling")
+    tabs.interrupt()
+    select {
+    case <-done:
+    case <-time.After(timeout):
+      logger.Error().Msg("ERR: Shutdown, task not finished")
+      return false
+    }
+  }
+  tabs.close()
+  logger.Info().Msg("shutdown, ok")
+  return true
+}
+
+func stopping() bool {
+  select {
+  case <-stopChan:
+    return true
+  default:
+    return false
+  }
+}
+
+// 等待d，Runner关闭时立即返回false
+func sleep(d time.Duration) bool {
+  timer := time.NewTimer(d)
+  defer timer.Stop()
+  select {
+  case <-timer.C:
+    return true
+  case <-stopChan:
+    return false
+  }
 }
 
 func initLogger() {
-  dir := Conf.Log.Dir
-  e := os.MkdirAll(dir+"/dump", os.ModePerm)
+  c := Conf.Log
+  e := os.MkdirAll(c.Dir+"/dump", 0755)
   if e != nil {
     panic(e)
   }
   l := zerolog.DebugLevel
-  switch strings.ToLower(Conf.Log.Level) {
+  switch strings.ToLower(c.Level) {
   case "info":
     l = zerolog.InfoLevel
   case "warn":
@@ -103,24 +199,28 @@ func initLogger() {
   }
   zerolog.SetGlobalLevel(l)
   zerolog.TimeFieldFormat = ""
-  if logFile != nil {
-    logFile.Close()
+  if strings.ToLower(c.Output) == "stdout" {
+    logOutput = nopWriteCloser{os.Stdout}
+  } else {
+    logOutput, e = newRotateWriter(c.Dir, int64(c.MaxSize)*1024*1024, c.Keep, c.Gzip)
+    if e != nil {
+      panic(e)
+    }
+  }
+  var w io.Writer = logOutput
+  if strings.ToLower(c.Format) == "console" {
+    w = zerolog.ConsoleWriter{Out: logOutput, NoColor: true}
   }
-  logFile, _ = os.Create(fmt.Sprintf("%s/runner_%s.log", dir, times.NowStrFormat(times.DateFormat3)))
-  lg := zerolog.New(logFile).Level(l).With().Timestamp().Logger()
+  lg := zerolog.New(w).Level(l).With().Timestamp().Logger()
   logger = &lg
-  now := times.Now()
-  next := now.Add(time.Hour * 24)
-  next = time.Date(next.Year(), next.Month(), next.Day(), 0, 0, 0, 0, next.Location())
-  time.AfterFunc(next.Sub(now), func() {
-    logger.Info().Msg("create log file")
-    go initLogger()
-  })
 }
 
 func initStore() {
+  if Conf.Store.Path == "" {
+    Conf.Store.Path = "runner.db"
+  }
   var e error
-  store, e = boltdb.Open("runner.db", "product")
+  store, e = boltdb.Open(Conf.Store.Path, string(bucketProducts), string(bucketHistory), string(bucketDiscovered))
   if e != nil {
     panic(e)
   }
@@ -144,295 +244,503 @@ func initChrome() {
   tab, _ := chrome.NewTab()
   defer tab.Close()
   msg := tab.Call(cdp.Browser.GetVersion)
-  logger.Info().Msg(msg.Result["product"].(string))
+  chromeVersion, _ = msg.Result["product"].(string)
+  logger.Info().Msg(chromeVersion)
+  tabs = newTabPool(chrome, Conf.Chrome.Tabs)
 }
 
-func initBeanstalk() {
-  var e error
-  for i := 0; i < 3; i++ {
-    conn, e = beanstalk.Dial(Conf.Beanstalk.Host, Conf.Beanstalk.Port)
-    if e != nil {
-      logger.Info().Msg("beanstalk connect failed, will retry 30 seconds later")
-      time.Sleep(time.Second * 30)
-      continue
-    }
-    conn.Use(Conf.Beanstalk.PutTube)
-    conn.Watch(Conf.Beanstalk.ReserveTube)
-    conn.Ignore("default")
-    conn.EnableHeartbeat(Conf.Beanstalk.Heartbeat)
-    break
-  }
-  if conn == nil {
-    panic(e)
+func closeChrome() {
+  tab, e := chrome.NewTab()
+  if e == nil {
+    tab.CallAsync(cdp.Browser.Close)
   }
 }
 
 func run() {
   // 外层循环是定时任务
   for range loopChan {
-    // 内层循环是一直取任务直到没有为止
+    processTasks()
+    scheduleNextTime()
+  }
+}
+
+// 一直取任务直到没有为止（或Runner关闭、暂停）
+func processTasks() {
+  working.Lock()
+  defer working.Unlock()
+  for !stopping() && atomic.LoadInt32(&paused) == 0 {
+    t := reserveTask()
+    if t == nil {
+      break
+    }
+    progress.begin(current, t)
+    processTask(current, t)
+    progress.end()
+    current = nil
+  }
+}
+
+// 处理任务，处理期间定时touch，
+// 完成后删除任务，失败时放回队列（delay之后可以再次取到），失败次数超过max_attempts时bury，
+// Runner关闭时没抓的部分作为新的任务放回队列
+func processTask(j *queueJob, t *Task) {
+  stop := touchJob(j)
+  rest, e := crawlTask(t)
+  stop()
+  if e != nil {
+    logger.Error().Err(e).Msgf("ERR: Process, jobID=%s, taskID=%s, attempts=%d", j.id, t.ID, j.attempts)
+    failJob(j)
+    return
+  }
+  if rest != nil {
+    data, _ := json.Marshal(rest)
+    e = queue.requeue(j, data)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Requeue")
+      return
+    }
+    logger.Info().Msgf("requeue task, ok, taskID=%s, count=%d", t.ID, len(rest.Payloads))
+    return
+  }
+  e = queue.ack(j)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Ack")
+  }
+}
+
+func touchJob(j *queueJob) func() {
+  if Conf.Queue.TouchInterval <= 0 {
+    return func() {}
+  }
+  ticker := time.NewTicker(time.Second * time.Duration(Conf.Queue.TouchInterval))
+  done := make(chan struct{})
+  go func() {
     for {
-      t := reserveTask()
-      if t == nil || len(t.Payloads) == 0 {
-        break
-      }
-      ch := make(chan *Product, 1)
-      go func() {
-        for p := range ch {
-          data, _ := json.Marshal(p)
-          store.UpdateV(bucketProducts, []byte(p.ID), data)
-        }
-      }()
-      messages := make([]*Message, 0, len(t.Payloads))
-      products := make([]*Product, 0, len(t.Payloads))
-      for _, payload := range t.Payloads {
-        if payload == nil {
-          continue
-        }
-        if payload.Message != nil && payload.Message.ID != "" {
-          messages = append(messages, payload.Message)
-        } else if payload.Product != nil && payload.Product.URL != "" {
-          products = append(products, payload.Product)
-        }
-      }
-      logger.Info().Msgf("%d messages, %d products", len(messages), len(products))
-      if len(messages) > 0 {
-        payloads := processMessages(ch, messages)
-        task := &Task{
-          ID:         t.ID,
-          CreateTime: t.CreateTime,
-          ReportTime: times.Now(),
-          Payloads:   payloads,
+      select {
+      case <-ticker.C:
+        e := queue.touch(j)
+        if e != nil {
+          logger.Error().Err(e).Msg("ERR: Touch")
         }
-        reportMessages(task)
+      case <-done:
+        return
       }
-      if len(products) > 0 {
-        payloads := processProducts(ch, products)
-        task := &Task{
-          ID:         t.ID,
-          CreateTime: t.CreateTime,
-          ReportTime: times.Now(),
-          Payloads:   payloads,
-        }
-        reportProducts(task)
+    }
+  }()
+  return func() {
+    ticker.Stop()
+    close(done)
+  }
+}
+
+func failJob(j *queueJob) {
+  if Conf.Queue.MaxAttempts > 0 && j.attempts >= Conf.Queue.MaxAttempts {
+    logger.Warn().Msgf("bury job, jobID=%s, attempts=%d", j.id, j.attempts)
+    e := queue.bury(j)
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Bury")
+    }
+    return
+  }
+  e := queue.nack(j, time.Second*time.Duration(Conf.Queue.ReleaseDelay))
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Release")
+  }
+}
+
+// 抓取任务并提交结果，Runner关闭时返回没抓的部分，
+// 消息的结果已经提交而商品的结果提交失败时，返回所有的商品（只重试没提交的部分）
+func crawlTask(t *Task) (rest *Task, e error) {
+  defer func() {
+    if r := recover(); r != nil {
+      e = fmt.Errorf("panic: %v", r)
+    }
+  }()
+  messages := make([]*Message, 0, len(t.Payloads))
+  products := make([]*Product, 0, len(t.Payloads))
+  for _, payload := range t.Payloads {
+    if payload == nil {
+      continue
+    }
+    if payload.Message != nil && payload.Message.ID != "" {
+      messages = append(messages, payload.Message)
+    } else if payload.Product != nil && payload.Product.URL != "" {
+      products = append(products, payload.Product)
+    }
+  }
+  logger.Info().Msgf("%d messages, %d products", len(messages), len(products))
+  left := make([]*Payload, 0, 4)
+  // 已经提交的抓到的商品，用于发现新商品
+  crawled := make([]*Payload, 0, len(t.Payloads))
+  if len(messages) > 0 {
+    payloads, results, restMessages := processMessages(messages)
+    task := &Task{
+      ID:         t.ID,
+      CreateTime: t.CreateTime,
+      ReportTime: times.Now(),
+      Payloads:   payloads,
+      Results:    results,
+    }
+    e = reportMessages(task)
+    if e != nil {
+      return nil, e
+    }
+    saveProducts(payloads)
+    crawled = append(crawled, payloads...)
+    for _, m := range restMessages {
+      left = append(left, &Payload{Message: m})
+    }
+  }
+  if len(products) > 0 {
+    var restProducts []*Product
+    if stopping() {
+      restProducts = products
+    } else {
+      var payloads []*Payload
+      var results []*Result
+      payloads, results, restProducts = processProducts(products)
+      task := &Task{
+        ID:         t.ID,
+        CreateTime: t.CreateTime,
+        ReportTime: times.Now(),
+        Payloads:   payloads,
+        Results:    results,
       }
-      e := conn.Delete(jobID)
+      e = reportProducts(task)
       if e != nil {
-        logger.Error().Err(e).Msg("ERR: Delete")
+        // 消息的结果已经提交，整个任务重试会重复提交
+        if len(messages) == 0 {
+          return nil, e
+        }
+        e = nil
+        restProducts = products
+      } else {
+        saveProducts(payloads)
+        crawled = append(crawled, payloads...)
       }
-      jobID = ""
-      close(ch)
     }
-    scheduleNextTime()
+    for _, p := range restProducts {
+      left = append(left, &Payload{Product: p})
+    }
   }
+  discoverProducts(t.ID, crawled)
+  if len(left) == 0 {
+    return nil, nil
+  }
+  return &Task{ID: t.ID, CreateTime: t.CreateTime, Payloads: left}, nil
 }
 
 func scheduleNextTime() {
   logger.Info().Msg("schedule next time")
-  time.AfterFunc(time.Minute*time.Duration(Conf.Task.PollingInterval), func() {
-    loopChan <- struct{}{}
-  })
+  pollMu.Lock()
+  defer pollMu.Unlock()
+  d := time.Minute * time.Duration(Conf.Task.PollingInterval)
+  if pollTimer == nil {
+    pollTimer = time.AfterFunc(d, poll)
+    return
+  }
+  pollTimer.Reset(d)
+}
+
+// 立即取任务，正在处理任务时在处理完后再取一次
+func poll() {
+  select {
+  case loopChan <- struct{}{}:
+  default:
+  }
 }
 
+// 取一个任务，格式错误的任务直接bury
 func reserveTask() *Task {
-  var e error
-  var job []byte
-  jobID, job, e = conn.ReserveWithTimeout(Conf.Beanstalk.ReserveTimeout)
-  if e != nil {
-    if e != beanstalk.ErrTimedOut {
-      logger.Error().Err(e).Msg("ERR: ReserveWithTimeout")
+  for {
+    var e error
+    current, e = queue.reserve()
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Reserve")
+      return nil
     }
-    return nil
-  }
-  t := &Task{}
-  e = json.Unmarshal(job, t)
-  if e != nil {
-    logger.Error().Err(e).Msg("ERR: Unmarshal")
-    return nil
+    if current == nil {
+      return nil
+    }
+    job := current.data
+    t := &Task{}
+    e = json.Unmarshal(job, t)
+    if e != nil {
+      logger.Error().Err(e).Msgf("ERR: Unmarshal, bury job, jobID=%s", current.id)
+      e = queue.bury(current)
+      if e != nil {
+        logger.Error().Err(e).Msg("ERR: Bury")
+        return nil
+      }
+      continue
+    }
+    dump(t.ID, "reserve", job)
+    logger.Info().Msgf("check task, ok, jobID=%s, taskID=%s, count=%d", current.id, t.ID, len(t.Payloads))
+    return t
   }
-  dump(fmt.Sprintf("%s/dump/%s_reserve.json", Conf.Log.Dir, t.ID), job)
-  logger.Info().Msgf("check task, ok, jobID=%s, taskID=%s, count=%d", jobID, t.ID, len(t.Payloads))
-  return t
 }
 
-func processMessages(ch chan<- *Product, arr []*Message) []*Payload {
+// 抓取所有消息，返回抓到的和每个消息的结果，Runner关闭时还返回没抓的
+func processMessages(arr []*Message) ([]*Payload, []*Result, []*Message) {
   payloads := make([]*Payload, len(arr))
+  // 每个消息最后一次抓取的结果和抓取的次数
+  crawled := make([]*crawlResult, len(arr))
+  attempts := make([]int, len(arr))
   // i为重试的次数，j为实际抓取的数量
-  i, j := 0, 0
+  var i, j int32
   for {
-    if i >= Conf.Task.CrawlRetry {
+    if int(i) >= Conf.Task.CrawlRetry {
       break
     }
-    if i != 0 {
-      time.Sleep(time.Second * 10)
+    if i != 0 && !sleep(retryInterval) {
+      break
     }
     i++
-    left := false
+    var left int32
     logger.Info().Msgf("[%d]process messages", i)
+    jobs := make([]*crawlJob, 0, len(arr))
     for n, m := range arr {
       if m == nil {
         continue
       }
-      payload := payloads[n]
-      if payload != nil && payload.Product != nil && payload.Product.ID != "" && payload.Product.Price != NoValue {
+      if payloads[n] != nil || (crawled[n] != nil && !crawled[n].retryable()) {
         continue
       }
-      p := crawlMessage(m)
-      // 返回nil表示发生了不可恢复的错误（如提取不到链接）
-      if p == nil {
-        continue
-      }
-      // 返回空Product表示发生了可恢复的错误（如超时），可能重试一次就好了
-      if p.ID == "" {
-        left = true
-        continue
+      site, c := politenessOf(currentRules(), messageURL(m))
+      jobs = append(jobs, &crawlJob{n: n, site: site, conf: c})
+    }
+    // 每个下标只会由一个goroutine处理，所以可以直接写payloads[n]、crawled[n]和attempts[n]
+    sched.run(jobs, func(n int) {
+      m := arr[n]
+      r := crawlMessage(currentRules(), m)
+      crawled[n] = r
+      attempts[n]++
+      if attempts[n] > 1 {
+        metricCrawlRetries.inc("message")
       }
-      if p.Price == NoValue || (p.Price == RangePrice && p.PriceLow == 0 && p.PriceHigh == 0) {
-        left = true
-        continue
+      progress.crawl(r.ok())
+      if !r.ok() {
+        logger.Warn().Msgf("crawl message %s failed, %s", m.ID, r)
+        // 可恢复的错误（如超时）可能重试一次就好了
+        if r.retryable() {
+          atomic.StoreInt32(&left, 1)
+        }
+        return
       }
+      p := r.Product
       p.ShortURL = shortenURL(p.URL)
       if p.ShortURL == "" {
         logger.Warn().Msg("get short url failed")
       }
       p.UpdateTime = times.Now()
-      payloads[n] = &Payload{Message: m, Product: p}
-      ch <- p
-      j++
+      payload := &Payload{Message: m, Product: p}
+      comparePrice(payload)
+      payloads[n] = payload
+      atomic.AddInt32(&j, 1)
       if p.Price == RangePrice {
         logger.Debug().Msgf("id=%s, price=[%.2f, %.2f]", p.ID, p.PriceLow, p.PriceHigh)
       } else {
         logger.Debug().Msgf("id=%s, price=%.2f", p.ID, p.Price)
       }
-    }
-    if !left {
+    })
+    if left == 0 || stopping() {
       break
     }
   }
   logger.Info().Msgf("process messages, ok, tried %d times, %d messages processed", i, j)
   ret := make([]*Payload, 0, len(arr))
+  results := make([]*Result, 0, len(arr))
+  var rest []*Message
+  for n, m := range arr {
+    r := crawled[n]
+    switch {
+    case m == nil:
+      continue
+    case payloads[n] != nil:
+      ret = append(ret, payloads[n])
+    case stopping() && (r == nil || r.retryable()):
+      rest = append(rest, m)
+      continue
+    case r == nil:
+      continue
+    }
+    result := r.result(attempts[n])
+    result.MessageID = m.ID
+    results = append(results, result)
+    metricPayloads.inc(result.Status)
+  }
+  return ret, results, rest
+}
+
+// 结果提交成功后再保存抓到的商品，
+// 否则提交失败重试时会因为crawl_duration内抓过而跳过，抓到的数据不会再提交
+func saveProducts(payloads []*Payload) {
   for _, v := range payloads {
-    if v != nil {
-      ret = append(ret, v)
+    if v.Product != nil {
+      saveProduct(v.Product)
     }
   }
-  return ret
 }
 
-func reportMessages(task *Task) {
+func reportMessages(task *Task) error {
   var e error
   data, _ := json.Marshal(task)
-  dump(fmt.Sprintf("%s/dump/%s_report_messages.json", Conf.Log.Dir, task.ID), data)
-  _, e = conn.Put(Conf.Beanstalk.PutPriority, Conf.Beanstalk.PutDelay, Conf.Beanstalk.PutTTR, data)
+  dump(task.ID, "report_messages", data)
+  e = queue.publish(data)
   if e != nil {
-    logger.Error().Err(e).Msg("ERR: Put")
-    panic(e)
+    logger.Error().Err(e).Msg("ERR: Publish")
+    return e
   }
+  metricTasksReported.inc("messages")
   logger.Info().Msg("report messages, ok")
+  return nil
 }
 
-func processProducts(ch chan<- *Product, arr []*Product) []*Payload {
+// 抓取所有商品，返回抓到的和每个商品的结果，Runner关闭时还返回没抓的
+func processProducts(arr []*Product) ([]*Payload, []*Result, []*Product) {
   payloads := make([]*Payload, len(arr))
+  // 每个商品最后一次抓取的结果和抓取的次数
+  crawled := make([]*crawlResult, len(arr))
+  attempts := make([]int, len(arr))
+  // 在crawl_duration内已经抓过的
+  skipped := make([]bool, len(arr))
   // i为重试的次数，j为实际抓取的数量
-  i, j := 0, 0
+  var i, j int32
   for {
-    if i >= Conf.Task.CrawlRetry {
+    if int(i) >= Conf.Task.CrawlRetry {
       break
     }
-    if i != 0 {
-      time.Sleep(time.Second * 10)
+    if i != 0 && !sleep(retryInterval) {
+      break
     }
     i++
-    left := false
+    var left int32
     logger.Info().Msgf("[%d]process products", i)
+    jobs := make([]*crawlJob, 0, len(arr))
     for n, m := range arr {
       if m == nil {
         continue
       }
-      payload := payloads[n]
-      if payload != nil && payload.Product != nil && payload.Product.ID != "" && payload.Product.Price != NoValue {
+      if payloads[n] != nil || skipped[n] || (crawled[n] != nil && !crawled[n].retryable()) {
         continue
       }
       if Conf.Task.CrawlDuration > 0 {
         duplicate := false
-        store.QueryV(bucketProducts, []byte(m.ID), func(k, v []byte, n int) error {
+        u := html.UnescapeString(m.URL)
+        key := productKey(m.ID, currentRules().findRuleByURL(u).pinnedSKU(u))
+        store.QueryV(bucketProducts, []byte(key), func(k, v []byte, n int) error {
           product := Product{}
           json.Unmarshal(v, &product)
           duplicate = times.Now().Sub(product.UpdateTime).Minutes() < float64(Conf.Task.CrawlDuration)
           return nil
         })
         if duplicate {
+          skipped[n] = true
           continue
         }
       }
-      p := crawlProduct(m)
-      // 返回nil表示发生了不可恢复的错误
-      if p == nil {
-        continue
-      }
-      // 返回空Product表示发生了可恢复的错误（如超时），可能重试一次就好了
-      if p.ID == "" || (p.ID != "" && m.ID != "" && p.ID != m.ID) {
-        left = true
-        continue
+      site, c := politenessOf(currentRules(), html.UnescapeString(m.URL))
+      jobs = append(jobs, &crawlJob{n: n, site: site, conf: c})
+    }
+    // 每个下标只会由一个goroutine处理，所以可以直接写payloads[n]、crawled[n]和attempts[n]
+    sched.run(jobs, func(n int) {
+      m := arr[n]
+      r := crawlProduct(currentRules(), m)
+      crawled[n] = r
+      attempts[n]++
+      if attempts[n] > 1 {
+        metricCrawlRetries.inc("product")
       }
-      if p.Price == NoValue || (p.Price == RangePrice && p.PriceLow == 0 && p.PriceHigh == 0) {
-        left = true
-        continue
+      progress.crawl(r.ok())
+      if !r.ok() {
+        logger.Warn().Msgf("crawl product %s failed, %s", m.ID, r)
+        // 可恢复的错误（如超时）可能重试一次就好了
+        if r.retryable() {
+          atomic.StoreInt32(&left, 1)
+        }
+        return
       }
+      p := r.Product
       p.ShortURL = shortenURL(p.URL)
       if p.ShortURL == "" {
         logger.Warn().Msg("get short url failed")
       }
       p.UpdateTime = times.Now()
-      payloads[n] = &Payload{Product: p}
-      ch <- p
-      j++
+      payload := &Payload{Product: p}
+      comparePrice(payload)
+      payloads[n] = payload
+      atomic.AddInt32(&j, 1)
       if p.Price == RangePrice {
         logger.Debug().Msgf("id=%s, price=[%.2f, %.2f]", p.ID, p.PriceLow, p.PriceHigh)
       } else {
         logger.Debug().Msgf("id=%s, price=%.2f", p.ID, p.Price)
       }
-    }
-    if !left {
+    })
+    if left == 0 || stopping() {
       break
     }
   }
   logger.Info().Msgf("process products, ok, tried %d times, %d products processed", i, j)
   ret := make([]*Payload, 0, len(arr))
-  for _, v := range payloads {
-    if v != nil {
-      ret = append(ret, v)
+  results := make([]*Result, 0, len(arr))
+  var rest []*Product
+  for n, m := range arr {
+    r := crawled[n]
+    switch {
+    case m == nil:
+      continue
+    case skipped[n]:
+      results = append(results, &Result{ProductID: m.ID, URL: m.URL, Status: statusSkipped})
+      metricPayloads.inc(statusSkipped)
+      continue
+    case payloads[n] != nil:
+      ret = append(ret, payloads[n])
+    case stopping() && (r == nil || r.retryable()):
+      rest = append(rest, m)
+      continue
+    case r == nil:
+      continue
     }
+    result := r.result(attempts[n])
+    if result.ProductID == "" {
+      result.ProductID = m.ID
+    }
+    result.URL = m.URL
+    results = append(results, result)
+    metricPayloads.inc(result.Status)
   }
-  return ret
+  return ret, results, rest
 }
 
-func reportProducts(task *Task) {
+func reportProducts(task *Task) error {
   var e error
   data, _ := json.Marshal(task)
-  dump(fmt.Sprintf("%s/dump/%s_report_products.json", Conf.Log.Dir, task.ID), data)
-  _, e = conn.Put(Conf.Beanstalk.PutPriority, Conf.Beanstalk.PutDelay, Conf.Beanstalk.PutTTR, data)
+  dump(task.ID, "report_products", data)
+  e = queue.publish(data)
   if e != nil {
-    logger.Error().Err(e).Msg("ERR: Put")
-    panic(e)
+    logger.Error().Err(e).Msg("ERR: Publish")
+    return e
   }
+  metricTasksReported.inc("products")
   logger.Info().Msg("report products, ok")
+  return nil
 }
 
 func shortenURL(addr string) string {
   for i := 0; i < 3; i++ {
-    r := httputil.ShortenURL(addr)
+    r := shorten(addr)
     if r != "" {
       return r
     }
     time.Sleep(time.Second)
   }
+  metricShortenFailures.inc()
   return ""
 }
 
-func dump(file string, data []byte) {
-  if file == "" || len(data) == 0 {
-    return
-  }
-  ioutil.WriteFile(file, data, os.ModePerm)
+// httputil.ShortenURL内部的随机数不能并发使用，只在调用时加锁，重试的间隔不占用锁
+func shorten(addr string) string {
+  shortenMu.Lock()
+  defer shortenMu.Unlock()
+  return shortener(addr)
 }
@@ -0,0 +1,375 @@
+package main
+
+import (
+  "encoding/json"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/boltdb"
+  "github.com/rs/zerolog"
+)
+
+func TestMain(m *testing.M) {
+  lg := zerolog.Nop()
+  logger = &lg
+  os.Exit(m.Run())
+}
+
+// 记录touch次数的队列
+type touchCounter struct {
+  taskQueue
+  touches int32
+}
+
+func (q *touchCounter) touch(j *queueJob) error {
+  atomic.AddInt32(&q.touches, 1)
+  return q.taskQueue.touch(j)
+}
+
+// 使用文件队列和临时的store，返回队列的配置
+func setupTaskQueue(t *testing.T) (*FileQueueConf, func()) {
+  dir, e := ioutil.TempDir("", "task")
+  if e != nil {
+    t.Fatal(e)
+  }
+  os.MkdirAll(filepath.Join(dir, "dump"), 0755)
+  oldLog, oldQueue := Conf.Log, Conf.Queue
+  Conf.Log.Dir = dir
+  Conf.Queue = QueueConf{MaxAttempts: 2}
+  conf := &FileQueueConf{
+    Reserve: filepath.Join(dir, "tasks.jsonl"),
+    Put:     filepath.Join(dir, "reports.jsonl"),
+    Buried:  filepath.Join(dir, "buried.jsonl"),
+  }
+  queue, _ = openFileQueue(conf)
+  teardownStore := setupStore(t)
+  return conf, func() {
+    teardownStore()
+    Conf.Log, Conf.Queue = oldLog, oldQueue
+    os.RemoveAll(dir)
+  }
+}
+
+// 使用临时的store
+func setupStore(t *testing.T) func() {
+  dir, e := ioutil.TempDir("", "store")
+  if e != nil {
+    t.Fatal(e)
+  }
+  store, e = boltdb.Open(filepath.Join(dir, "runner.db"), string(bucketProducts), string(bucketHistory), string(bucketDiscovered))
+  if e != nil {
+    t.Fatal(e)
+  }
+  return func() {
+    store.Close()
+    os.RemoveAll(dir)
+  }
+}
+
+func readLines(t *testing.T, file string) []string {
+  data, _ := ioutil.ReadFile(file)
+  return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestProcessTasks(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 2)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  fc.Evaluate = shopEvaluate
+
+  tasks := []string{
+    `not json`,
+    `{"id":"t1","payloads":[{"product":{"id":"31","url":"https://www.shop.test/item?id=31"}}]}`,
+    `{"id":"t2"}`,
+  }
+  ioutil.WriteFile(conf.Reserve, []byte(strings.Join(tasks, "\n")+"\n"), 0644)
+  processTasks()
+  reports := readLines(t, conf.Put)
+  if len(reports) != 1 || !strings.Contains(reports[0], `"id":"t1"`) || !strings.Contains(reports[0], `"price":31`) {
+    t.Errorf("unexpected reports %v", reports)
+  }
+  if buried := readLines(t, conf.Buried); len(buried) != 1 || buried[0] != "not json" {
+    t.Errorf("unexpected buried %v", buried)
+  }
+  if store.Get(bucketProducts, []byte("31")) == nil {
+    t.Error("product not stored")
+  }
+
+  // crawl_duration内抓过的商品不再抓，报告中的状态为skipped
+  Conf.Task.CrawlDuration = 60
+  f, _ := os.OpenFile(conf.Reserve, os.O_WRONLY|os.O_APPEND, 0644)
+  f.WriteString(`{"id":"t4","payloads":[{"product":{"id":"31","url":"https://www.shop.test/item?id=31"}}]}` + "\n")
+  f.Close()
+  processTasks()
+  Conf.Task.CrawlDuration = 0
+  reports = readLines(t, conf.Put)
+  if len(reports) != 2 || !strings.Contains(reports[1], `"results":[{"product_id":"31","url":"https://www.shop.test/item?id=31","status":"skipped"}]`) || strings.Contains(reports[1], `"payloads"`) {
+    t.Errorf("unexpected reports %v", reports)
+  }
+  if n := fc.count("PRICE(31)"); n != 1 {
+    t.Errorf("expect 1 crawl, got %d", n)
+  }
+
+  // 提交失败的任务放回队列，超过max_attempts后bury
+  conf.Put = os.TempDir()
+  f, _ = os.OpenFile(conf.Reserve, os.O_WRONLY|os.O_APPEND, 0644)
+  f.WriteString(`{"id":"t3","payloads":[{"product":{"id":"33","url":"https://www.shop.test/item?id=33"}}]}` + "\n")
+  f.Close()
+  processTasks()
+  if buried := readLines(t, conf.Buried); len(buried) != 2 || !strings.Contains(buried[1], `"id":"t3"`) {
+    t.Errorf("unexpected buried %v", buried)
+  }
+  if n := fc.count("PRICE(33)"); n != 2 {
+    t.Errorf("expect 2 attempts, got %d", n)
+  }
+  if j, _ := queue.reserve(); j != nil {
+    t.Errorf("expect no job, got %s", j.data)
+  }
+}
+
+func TestTouchJob(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  tc := &touchCounter{taskQueue: queue}
+  queue = tc
+  Conf.Queue.TouchInterval = 1
+  Conf.Task.CrawlTimeout = 2
+  fc.Evaluate = shopEvaluate
+  // 页面一直没有加载完成，抓取时要等crawl_timeout
+  fc.Load = func(string) time.Duration {
+    return -1
+  }
+  ioutil.WriteFile(conf.Reserve, []byte(`{"id":"t1","payloads":[{"product":{"id":"41","url":"https://www.shop.test/item?id=41"}}]}`+"\n"), 0644)
+  processTasks()
+  if n := atomic.LoadInt32(&tc.touches); n == 0 {
+    t.Error("expect job to be touched")
+  }
+}
+
+// 第n次提交失败的队列
+type publishFailer struct {
+  taskQueue
+  n         int32
+  published int32
+}
+
+func (q *publishFailer) publish(data []byte) error {
+  if atomic.AddInt32(&q.published, 1) == q.n {
+    return errors.New("publish failed")
+  }
+  return q.taskQueue.publish(data)
+}
+
+func TestProcessTaskPartialReport(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  fc.Evaluate = shopEvaluate
+  Conf.Task.CrawlDuration = 60
+  // 消息的结果提交成功，商品的结果提交失败
+  queue = &publishFailer{taskQueue: queue, n: 2}
+  task := `{"id":"t1","payloads":[{"message":{"id":"m1","url":"https://www.shop.test/item?id=51"}},{"product":{"id":"52","url":"https://www.shop.test/item?id=52"}}]}`
+  ioutil.WriteFile(conf.Reserve, []byte(task+"\n"), 0644)
+  j, _ := queue.reserve()
+  processTask(j, parseTask(t, j.data))
+  reports := readLines(t, conf.Put)
+  if len(reports) != 1 || !strings.Contains(reports[0], `"id":"m1"`) || strings.Contains(reports[0], `"id":"52"`) {
+    t.Errorf("unexpected reports %v", reports)
+  }
+  // 只有没提交的商品放回队列，原任务已经删除
+  j, _ = queue.reserve()
+  if j == nil {
+    t.Fatal("expect requeued job")
+  }
+  rest := string(j.data)
+  if strings.Contains(rest, `"id":"m1"`) || !strings.Contains(rest, `"id":"52"`) {
+    t.Errorf("unexpected requeued job %s", rest)
+  }
+  // 没提交的商品没有保存，重试时不会因为crawl_duration内抓过而跳过
+  if store.Get(bucketProducts, []byte("52")) != nil {
+    t.Error("unreported product stored")
+  }
+  processTask(j, parseTask(t, j.data))
+  reports = readLines(t, conf.Put)
+  if len(reports) != 2 || !strings.Contains(reports[1], `"price":52`) || strings.Contains(reports[1], statusSkipped) {
+    t.Errorf("unexpected reports %v", reports)
+  }
+  if store.Get(bucketProducts, []byte("52")) == nil {
+    t.Error("product not stored")
+  }
+  if j, _ := queue.reserve(); j != nil {
+    t.Errorf("expect no job, got %s", j.data)
+  }
+}
+
+func parseTask(t *testing.T, data []byte) *Task {
+  task := &Task{}
+  if e := json.Unmarshal(data, task); e != nil {
+    t.Fatal(e)
+  }
+  return task
+}
+
+// 开始处理任务，delay之后关闭Runner
+func shutdownAfter(delay, timeout time.Duration) {
+  finished := make(chan struct{})
+  go func() {
+    processTasks()
+    close(finished)
+  }()
+  time.Sleep(delay)
+  shutdown(timeout)
+  <-finished
+  stopChan = make(chan struct{})
+}
+
+// 任务一直没处理完时返回false，不关闭标签页（main不能再关闭store和队列）
+func TestShutdownUnfinished(t *testing.T) {
+  oldTabs := tabs
+  tabs = newTabPool("", 1)
+  defer func() {
+    tabs = oldTabs
+    stopChan = make(chan struct{})
+  }()
+  working.Lock()
+  defer working.Unlock()
+  if shutdown(time.Millisecond * 50) {
+    t.Error("expect shutdown to report unfinished task")
+  }
+}
+
+func TestShutdown(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  oldShortener := shortener
+  shortener = func(string) string {
+    return "https://t.cn/x"
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  fc.Evaluate = shopEvaluate
+  fc.Load = func(string) time.Duration {
+    return time.Millisecond * 300
+  }
+  task := `{"id":"t1","payloads":[{"product":{"id":"31","url":"https://www.shop.test/item?id=31"}},{"product":{"id":"32","url":"https://www.shop.test/item?id=32"}},{"product":{"id":"33","url":"https://www.shop.test/item?id=33"}}]}`
+  ioutil.WriteFile(conf.Reserve, []byte(task+"\n"), 0644)
+
+  // 正在抓的商品抓完后提交，没抓的放回队列
+  shutdownAfter(time.Millisecond*100, time.Second)
+  reports := readLines(t, conf.Put)
+  if len(reports) != 1 || !strings.Contains(reports[0], `"id":"31"`) || strings.Contains(reports[0], `"id":"32"`) {
+    t.Errorf("unexpected reports %v", reports)
+  }
+  j, _ := queue.reserve()
+  if j == nil {
+    t.Fatal("expect requeued job")
+  }
+  rest := string(j.data)
+  if strings.Contains(rest, `"id":"31"`) || !strings.Contains(rest, `"id":"32"`) || !strings.Contains(rest, `"id":"33"`) {
+    t.Errorf("unexpected requeued job %s", rest)
+  }
+}
+
+func TestShutdownTimeout(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  conf, teardownQueue := setupTaskQueue(t)
+  defer teardownQueue()
+  Conf.Task.CrawlTimeout = 5
+  fc.Evaluate = shopEvaluate
+  // 页面一直没有加载完成
+  fc.Load = func(string) time.Duration {
+    return -1
+  }
+  ioutil.WriteFile(conf.Reserve, []byte(`{"id":"t1","payloads":[{"product":{"id":"31","url":"https://www.shop.test/item?id=31"}}]}`+"\n"), 0644)
+
+  start := time.Now()
+  shutdownAfter(time.Millisecond*100, time.Millisecond*300)
+  if d := time.Since(start); d > time.Second*2 {
+    t.Errorf("expect crawling to be interrupted, took %v", d)
+  }
+  j, _ := queue.reserve()
+  if j == nil || !strings.Contains(string(j.data), `"id":"31"`) {
+    t.Fatalf("expect requeued job, got %v", j)
+  }
+}
+
+func TestShortenURL(t *testing.T) {
+  oldShortener := shortener
+  defer func() {
+    shortener = oldShortener
+  }()
+  // 每个链接第一次失败，第二次成功
+  var mu sync.Mutex
+  failed := make(map[string]bool)
+  shortener = func(addr string) string {
+    mu.Lock()
+    defer mu.Unlock()
+    if !failed[addr] {
+      failed[addr] = true
+      return ""
+    }
+    return "https://t.cn/" + addr
+  }
+  // 重试的间隔不占用锁，两个链接同时重试
+  start := time.Now()
+  var wg sync.WaitGroup
+  for _, addr := range []string{"a", "b"} {
+    wg.Add(1)
+    go func(addr string) {
+      defer wg.Done()
+      if r := shortenURL(addr); r != "https://t.cn/"+addr {
+        t.Errorf("unexpected short url %q", r)
+      }
+    }(addr)
+  }
+  wg.Wait()
+  if d := time.Since(start); d >= time.Millisecond*1900 {
+    t.Errorf("expect retries not to block each other, took %v", d)
+  }
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+  "fmt"
+  "io"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// 导出给Prometheus的指标（text格式），由metrics.addr配置监听地址，为空时不监听，
+// 没有引入Prometheus的客户端库，只实现了用到的counter、gauge和histogram
+var (
+  metricTasksReserved = newCounter("hiprice_tasks_reserved_total", "Tasks reserved from the queue.")
+  metricTasksReported = newCounter("hiprice_tasks_reported_total", "Reports published to the queue.", "kind")
+
+  // status与Result.Status相同
+  metricPayloads = newCounter("hiprice_payloads_total", "Payloads processed by final status.", "status")
+
+  metricCrawlDuration = newHistogram("hiprice_crawl_duration_seconds", "Time of a single crawl.", []float64{0.5, 1, 2, 5, 10, 20, 30, 60}, "rule")
+  metricCrawlRetries  = newCounter("hiprice_crawl_retries_total", "Crawls retried after a failed attempt.", "kind")
+
+  // 每个脚本执行的次数和没抓到值的次数（如价格仍然是NoValue）
+  metricExtract         = newCounter("hiprice_extract_total", "Scripts evaluated.", "rule", "field")
+  metricExtractFailures = newCounter("hiprice_extract_failures_total", "Scripts that produced no value.", "rule", "field")
+
+  metricDiscovered = newCounter("hiprice_discovered_products_total", "New products reported to the discover queue.", "rule")
+
+  metricShortenFailures = newCounter("hiprice_shorten_failures_total", "Short URL requests that failed.")
+  metricQueueErrors     = newCounter("hiprice_queue_errors_total", "Queue operations that failed.", "type", "op")
+
+  metricTabsOpen = newGauge("hiprice_chrome_tabs_open", "Chrome tabs opened by the tab pool.", func() float64 {
+    if tabs == nil {
+      return 0
+    }
+    return float64(tabs.opened())
+  })
+  metricTabsBusy = newGauge("hiprice_chrome_tabs_busy", "Chrome tabs in use.", func() float64 {
+    if tabs == nil {
+      return 0
+    }
+    return float64(tabs.inUse())
+  })
+
+  metrics = []metric{
+    metricTasksReserved, metricTasksReported, metricPayloads,
+    metricCrawlDuration, metricCrawlRetries,
+    metricExtract, metricExtractFailures,
+    metricDiscovered,
+    metricShortenFailures, metricQueueErrors,
+    metricTabsOpen, metricTabsBusy,
+  }
+)
+
+type metric interface {
+  write(w io.Writer)
+}
+
+// 按标签值分组的计数器
+type counter struct {
+  name, help string
+  labels     []string
+
+  mu     sync.Mutex
+  values map[string]float64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+  return &counter{name: name, help: help, labels: labels, values: make(map[string]float64, 4)}
+}
+
+// values是与labels对应的标签值
+func (c *counter) inc(values ...string) {
+  c.add(1, values...)
+}
+
+func (c *counter) add(n float64, values ...string) {
+  k := labelString(c.labels, values)
+  c.mu.Lock()
+  c.values[k] += n
+  c.mu.Unlock()
+}
+
+func (c *counter) get(values ...string) float64 {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.values[labelString(c.labels, values)]
+}
+
+func (c *counter) write(w io.Writer) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  for _, k := range sortedKeys(c.values) {
+    fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatFloat(c.values[k]))
+  }
+}
+
+// 采集时才计算值
+type gauge struct {
+  name, help string
+  f          func() float64
+}
+
+func newGauge(name, help string, f func() float64) *gauge {
+  return &gauge{name: name, help: help, f: f}
+}
+
+func (g *gauge) write(w io.Writer) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.f()))
+}
+
+type histogram struct {
+  name, help string
+  buckets    []float64
+  labels     []string
+
+  mu     sync.Mutex
+  series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+  // 每个bucket（小于等于）的数量，不是累加的
+  counts []uint64
+  count  uint64
+  sum    float64
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+  return &histogram{name: name, help: help, buckets: buckets, labels: labels, series: make(map[string]*histogramSeries, 4)}
+}
+
+func (h *histogram) observe(v float64, values ...string) {
+  k := labelString(h.labels, values)
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  s := h.series[k]
+  if s == nil {
+    s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+    h.series[k] = s
+  }
+  for i, b := range h.buckets {
+    if v <= b {
+      s.counts[i]++
+      break
+    }
+  }
+  s.count++
+  s.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+  fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  keys := make([]string, 0, len(h.series))
+  for k := range h.series {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for _, k := range keys {
+    s := h.series[k]
+    var n uint64
+    for i, b := range h.buckets {
+      n += s.counts[i]
+      fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(k, "le", formatFloat(b)), n)
+    }
+    fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(k, "le", "+Inf"), s.count)
+    fmt.Fprintf(w, "%s_sum%s %s\n", h.name, k, formatFloat(s.sum))
+    fmt.Fprintf(w, "%s_count%s %d\n", h.name, k, s.count)
+  }
+}
+
+// 标签的字符串形式，如{rule="jd",field="price"}，没有标签时为空字符串
+func labelString(labels, values []string) string {
+  if len(labels) == 0 {
+    return ""
+  }
+  arr := make([]string, len(labels))
+  for i, l := range labels {
+    v := ""
+    if i < len(values) {
+      v = values[i]
+    }
+    arr[i] = l + "=" + strconv.Quote(v)
+  }
+  return "{" + strings.Join(arr, ",") + "}"
+}
+
+// 在标签的字符串形式中增加一个标签
+func withLabel(s, label, value string) string {
+  l := label + "=" + strconv.Quote(value)
+  if s == "" {
+    return "{" + l + "}"
+  }
+  return s[:len(s)-1] + "," + l + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+  ret := make([]string, 0, len(m))
+  for k := range m {
+    ret = append(ret, k)
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+func formatFloat(v float64) string {
+  return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetrics(w io.Writer) {
+  for _, m := range metrics {
+    m.write(w)
+  }
+}
+
+// 启动metrics的HTTP服务（/metrics），返回实际监听的地址
+func serveMetrics(addr string) (string, error) {
+  l, e := net.Listen("tcp", addr)
+  if e != nil {
+    return "", e
+  }
+  mux := http.NewServeMux()
+  mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    writeMetrics(w)
+  })
+  srv := &http.Server{Handler: mux, ReadTimeout: time.Second * 10, WriteTimeout: time.Second * 10}
+  go srv.Serve(l)
+  return l.Addr().String(), nil
+}
+
+// 统计队列操作的错误
+type meteredQueue struct {
+  taskQueue
+  typ string
+}
+
+func (q *meteredQueue) count(op string, e error) error {
+  if e != nil {
+    metricQueueErrors.inc(q.typ, op)
+  }
+  return e
+}
+
+func (q *meteredQueue) reserve() (*queueJob, error) {
+  j, e := q.taskQueue.reserve()
+  if j != nil {
+    metricTasksReserved.inc()
+  }
+  return j, q.count("reserve", e)
+}
+
+func (q *meteredQueue) ack(j *queueJob) error {
+  return q.count("ack", q.taskQueue.ack(j))
+}
+
+func (q *meteredQueue) nack(j *queueJob, delay time.Duration) error {
+  return q.count("nack", q.taskQueue.nack(j, delay))
+}
+
+func (q *meteredQueue) touch(j *queueJob) error {
+  return q.count("touch", q.taskQueue.touch(j))
+}
+
+func (q *meteredQueue) bury(j *queueJob) error {
+  return q.count("bury", q.taskQueue.bury(j))
+}
+
+func (q *meteredQueue) requeue(j *queueJob, data []byte) error {
+  return q.count("requeue", q.taskQueue.requeue(j, data))
+}
+
+func (q *meteredQueue) publish(data []byte) error {
+  return q.count("publish", q.taskQueue.publish(data))
+}
+
+func (q *meteredQueue) discover(data []byte) error {
+  return q.count("discover", q.taskQueue.discover(data))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+  "bytes"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+  c := newCounter("test_total", "Test.", "rule", "field")
+  c.inc("shop", "price")
+  c.add(2, "shop", "price")
+  c.inc("shop", `ti"tle`)
+  h := newHistogram("test_seconds", "Test.", []float64{1, 5}, "rule")
+  h.observe(0.5, "shop")
+  h.observe(3, "shop")
+  h.observe(10, "shop")
+  buf := &bytes.Buffer{}
+  c.write(buf)
+  h.write(buf)
+  expect := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{rule="shop",field="price"} 3
+test_total{rule="shop",field="ti\"tle"} 1
+# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{rule="shop",le="1"} 1
+test_seconds_bucket{rule="shop",le="5"} 2
+test_seconds_bucket{rule="shop",le="+Inf"} 3
+test_seconds_sum{rule="shop"} 13.5
+test_seconds_count{rule="shop"} 3
+`
+  if buf.String() != expect {
+    t.Errorf("unexpected output:\n%s", buf.String())
+  }
+}
+
+func TestCrawlMetrics(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  rs, restore := setupTestRules(t)
+  defer restore()
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    if strings.HasPrefix(expression, "TITLE") {
+      return "", true
+    }
+    return shopEvaluate(addr, expression)
+  }
+  extract, failures := metricExtract.get("shop", "title"), metricExtractFailures.get("shop", "title")
+  doCrawl(normalizeURL(rs, "https://www.shop.test/item?id=1"))
+  if n := metricExtract.get("shop", "title") - extract; n != 1 {
+    t.Errorf("expect 1 title extracted, got %v", n)
+  }
+  if n := metricExtractFailures.get("shop", "title") - failures; n != 1 {
+    t.Errorf("expect 1 title failure, got %v", n)
+  }
+
+  addr, e := serveMetrics("127.0.0.1:0")
+  if e != nil {
+    t.Fatal(e)
+  }
+  resp, e := http.Get("http://" + addr + "/metrics")
+  if e != nil {
+    t.Fatal(e)
+  }
+  data, _ := ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+  for _, s := range []string{
+    `hiprice_crawl_duration_seconds_count{rule="shop"}`,
+    `hiprice_extract_failures_total{rule="shop",field="title"}`,
+    "hiprice_chrome_tabs_open 1",
+  } {
+    if !strings.Contains(string(data), s) {
+      t.Errorf("expect %s in metrics", s)
+    }
+  }
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+  "errors"
+  "time"
+)
+
+// 任务队列，Runner从队列中取任务（reserve），抓完后提交结果（publish）并删除任务（ack），
+// 没处理完的任务放回队列（nack），处理时间较长时要定时touch，防止任务超时后被其他Runner取走，
+// 支持Beanstalk（默认）、Redis Streams和JSONL文件（用于本地调试），由queue.type配置
+type taskQueue interface {
+  // 取一个任务，没有任务时返回nil
+  reserve() (*queueJob, error)
+
+  // 任务已完成，从队列中删除
+  ack(j *queueJob) error
+
+  // 任务没完成，delay之后可以再次被取到
+  nack(j *queueJob, delay time.Duration) error
+
+  // 延长任务的处理时间
+  touch(j *queueJob) error
+
+  // 任务无法处理（格式错误或失败次数太多），不再被取到，留给人工处理
+  bury(j *queueJob) error
+
+  // 删除任务，并把data（任务没处理的部分）作为新的任务放回队列
+  requeue(j *queueJob, data []byte) error
+
+  // 提交抓取结果
+  publish(data []byte) error
+
+  // 提交发现的新商品（单独的队列），没有配置发现队列时返回errNoDiscover
+  discover(data []byte) error
+
+  close() error
+}
+
+type queueJob struct {
+  // 任务在队列中的ID（Beanstalk的job id、Stream的entry id或文件中的行号）
+  id string
+
+  data []byte
+
+  // 第几次被取到（包括这一次）
+  attempts int
+
+  // 任务的优先级和TTR（Beanstalk），放回队列时保持不变
+  priority int
+  ttr      int
+}
+
+var (
+  queue taskQueue
+
+  errQueueType  = errors.New("unknown queue type")
+  errNoDiscover = errors.New("no discover queue")
+)
+
+func openQueue() (taskQueue, error) {
+  switch Conf.Queue.Type {
+  case "", "beanstalk":
+    return openBeanstalkQueue(&Conf.Beanstalk)
+  case "redis":
+    return openRedisQueue(&Conf.Queue.Redis)
+  case "file":
+    return openFileQueue(&Conf.Queue.File)
+  }
+  return nil, errQueueType
+}
+
+func initQueue() {
+  var e error
+  for i := 0; i < 3; i++ {
+    queue, e = openQueue()
+    if e == errQueueType {
+      break
+    }
+    if e != nil {
+      logger.Info().Msgf("%s connect failed, will retry 30 seconds later", Conf.Queue.Type)
+      time.Sleep(time.Second * 30)
+      continue
+    }
+    break
+  }
+  if queue == nil {
+    panic(e)
+  }
+  typ := Conf.Queue.Type
+  if typ == "" {
+    typ = "beanstalk"
+  }
+  queue = &meteredQueue{taskQueue: queue, typ: typ}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/beanstalk"
+  "gopkg.in/yaml.v2"
+)
+
+// beanstalk.Conn不能并发使用，所有的命令（包括心跳）都要加锁
+type beanstalkQueue struct {
+  conf *BeanstalkConf
+
+  mu   sync.Mutex
+  conn *beanstalk.Conn
+
+  heartbeat *time.Ticker
+}
+
+func openBeanstalkQueue(conf *BeanstalkConf) (taskQueue, error) {
+  conn, e := beanstalk.Dial(conf.Host, conf.Port)
+  if e != nil {
+    return nil, e
+  }
+  if conf.PutTube != "" {
+    e = conn.Use(conf.PutTube)
+  }
+  if e == nil {
+    _, e = conn.Watch(conf.ReserveTube)
+  }
+  if e == nil && conf.ReserveTube != "default" {
+    _, e = conn.Ignore("default")
+  }
+  if e != nil {
+    conn.Quit()
+    return nil, e
+  }
+  q := &beanstalkQueue{conf: conf, conn: conn}
+  if conf.Heartbeat > 0 {
+    q.heartbeat = time.NewTicker(time.Second * time.Duration(conf.Heartbeat))
+    go func() {
+      for range q.heartbeat.C {
+        q.mu.Lock()
+        q.conn.Ignore("heartbeat00")
+        q.mu.Unlock()
+      }
+    }()
+  }
+  return q, nil
+}
+
+func (q *beanstalkQueue) reserve() (*queueJob, error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  id, data, e := q.conn.ReserveWithTimeout(q.conf.ReserveTimeout)
+  if e == beanstalk.ErrTimedOut {
+    return nil, nil
+  }
+  if e != nil {
+    return nil, e
+  }
+  j := &queueJob{id: id, data: data, attempts: 1, priority: q.conf.PutPriority, ttr: q.conf.PutTTR}
+  // 从stats-job中得到取到的次数、优先级和TTR，失败时按第一次处理
+  stats, e := q.conn.StatsJob(id)
+  if e == nil {
+    v := &struct {
+      Pri      int `yaml:"pri"`
+      TTR      int `yaml:"ttr"`
+      Reserves int `yaml:"reserves"`
+    }{}
+    if yaml.Unmarshal(stats, v) == nil && v.Reserves > 0 {
+      j.attempts, j.priority, j.ttr = v.Reserves, v.Pri, v.TTR
+    }
+  }
+  return j, nil
+}
+
+func (q *beanstalkQueue) ack(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.conn.Delete(j.id)
+}
+
+func (q *beanstalkQueue) nack(j *queueJob, delay time.Duration) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.conn.Release(j.id, j.priority, int(delay/time.Second))
+}
+
+func (q *beanstalkQueue) touch(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.conn.Touch(j.id)
+}
+
+func (q *beanstalkQueue) bury(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.conn.Bury(j.id, j.priority)
+}
+
+func (q *beanstalkQueue) requeue(j *queueJob, data []byte) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  e := q.putTo(q.conf.ReserveTube, j.priority, 0, j.ttr, data)
+  if e != nil {
+    return e
+  }
+  return q.conn.Delete(j.id)
+}
+
+func (q *beanstalkQueue) publish(data []byte) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  _, e := q.conn.Put(q.conf.PutPriority, q.conf.PutDelay, q.conf.PutTTR, data)
+  return e
+}
+
+func (q *beanstalkQueue) discover(data []byte) error {
+  if q.conf.DiscoverTube == "" {
+    return errNoDiscover
+  }
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.putTo(q.conf.DiscoverTube, q.conf.PutPriority, q.conf.PutDelay, q.conf.PutTTR, data)
+}
+
+// 提交到其他tube，之后切换回put_tube（为空时是default），调用时要持有q.mu
+func (q *beanstalkQueue) putTo(tube string, priority, delay, ttr int, data []byte) error {
+  e := q.conn.Use(tube)
+  if e != nil {
+    return e
+  }
+  _, e = q.conn.Put(priority, delay, ttr, data)
+  tube = q.conf.PutTube
+  if tube == "" {
+    tube = "default"
+  }
+  if e2 := q.conn.Use(tube); e == nil {
+    e = e2
+  }
+  return e
+}
+
+func (q *beanstalkQueue) close() error {
+  if q.heartbeat != nil {
+    q.heartbeat.Stop()
+  }
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return q.conn.Quit()
+}
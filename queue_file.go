@@ -0,0 +1,190 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "fmt"
+  "io"
+  "os"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// 基于JSONL文件的任务队列，用于本地调试，
+// 从reserve文件中按行读取任务（每行一个任务，运行时追加的行也会被读到），结果按行追加到put文件，
+// bury的任务按行追加到buried文件，
+// 任务的状态只保存在内存中，重启后会从头读取
+type fileQueue struct {
+  conf *FileQueueConf
+
+  mu sync.Mutex
+
+  // 已经读取的字节数和行数
+  offset int64
+  line   int
+
+  // 等待处理的任务和可以被取到的时间
+  waiting []*fileJob
+
+  // 已经取走还没有ack/nack的任务
+  reserved map[string]*queueJob
+}
+
+type fileJob struct {
+  job *queueJob
+  at  time.Time
+}
+
+func openFileQueue(conf *FileQueueConf) (taskQueue, error) {
+  if conf.Reserve == "" || conf.Put == "" {
+    return nil, fmt.Errorf("queue.file.reserve and queue.file.put are required")
+  }
+  return &fileQueue{conf: conf, reserved: make(map[string]*queueJob, 2)}, nil
+}
+
+// 读取新追加的任务，不完整的行（没有换行符）留到下次再读
+func (q *fileQueue) scan() error {
+  f, e := os.Open(q.conf.Reserve)
+  if os.IsNotExist(e) {
+    return nil
+  }
+  if e != nil {
+    return e
+  }
+  defer f.Close()
+  _, e = f.Seek(q.offset, io.SeekStart)
+  if e != nil {
+    return e
+  }
+  r := bufio.NewReader(f)
+  for {
+    line, e := r.ReadBytes('\n')
+    if e == io.EOF {
+      return nil
+    }
+    if e != nil {
+      return e
+    }
+    q.offset += int64(len(line))
+    q.line++
+    line = bytes.TrimSpace(line)
+    if len(line) == 0 {
+      continue
+    }
+    j := &queueJob{id: strconv.Itoa(q.line), data: line}
+    q.waiting = append(q.waiting, &fileJob{job: j})
+  }
+}
+
+func (q *fileQueue) reserve() (*queueJob, error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  e := q.scan()
+  if e != nil {
+    return nil, e
+  }
+  now := time.Now()
+  for i, fj := range q.waiting {
+    if fj.at.After(now) {
+      continue
+    }
+    q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+    fj.job.attempts++
+    q.reserved[fj.job.id] = fj.job
+    j := *fj.job
+    return &j, nil
+  }
+  return nil, nil
+}
+
+func (q *fileQueue) ack(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if _, ok := q.reserved[j.id]; !ok {
+    return fmt.Errorf("job %s not reserved", j.id)
+  }
+  delete(q.reserved, j.id)
+  return nil
+}
+
+func (q *fileQueue) nack(j *queueJob, delay time.Duration) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  reserved, ok := q.reserved[j.id]
+  if !ok {
+    return fmt.Errorf("job %s not reserved", j.id)
+  }
+  delete(q.reserved, j.id)
+  q.waiting = append(q.waiting, &fileJob{job: reserved, at: time.Now().Add(delay)})
+  return nil
+}
+
+func (q *fileQueue) touch(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if _, ok := q.reserved[j.id]; !ok {
+    return fmt.Errorf("job %s not reserved", j.id)
+  }
+  return nil
+}
+
+func (q *fileQueue) bury(j *queueJob) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if _, ok := q.reserved[j.id]; !ok {
+    return fmt.Errorf("job %s not reserved", j.id)
+  }
+  delete(q.reserved, j.id)
+  if q.conf.Buried == "" {
+    return nil
+  }
+  return appendLine(q.conf.Buried, j.data)
+}
+
+// 放回的任务只保存在内存中，ID是原任务的ID加上"+"
+func (q *fileQueue) requeue(j *queueJob, data []byte) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if _, ok := q.reserved[j.id]; !ok {
+    return fmt.Errorf("job %s not reserved", j.id)
+  }
+  delete(q.reserved, j.id)
+  q.waiting = append(q.waiting, &fileJob{job: &queueJob{id: j.id + "+", data: data}})
+  return nil
+}
+
+func (q *fileQueue) publish(data []byte) error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return appendLine(q.conf.Put, data)
+}
+
+func (q *fileQueue) discover(data []byte) error {
+  if q.conf.Discover == "" {
+    return errNoDiscover
+  }
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return appendLine(q.conf.Discover, data)
+}
+
+func appendLine(file string, data []byte) error {
+  f, e := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+  if e != nil {
+    return e
+  }
+  data = bytes.TrimSpace(data)
+  line := make([]byte, len(data)+1)
+  copy(line, data)
+  line[len(data)] = '\n'
+  _, e = f.Write(line)
+  if e2 := f.Close(); e == nil {
+    e = e2
+  }
+  return e
+}
+
+func (q *fileQueue) close() error {
+  return nil
+}
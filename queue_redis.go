@@ -0,0 +1,306 @@
+package main
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// 基于Redis Streams（需要Redis 5.0以上，XAUTOCLAIM需要6.2以上）的任务队列，
+// 任务是reserve_stream中的entry（data字段是任务的JSON），Runner以consumer group的方式读取，
+// 取到的任务在ack之前一直在group的pending列表中，超过ttr没有touch的任务会被其他Runner（或重启后的自己）取走，
+// nack是把任务的空闲时间设置为ttr-delay，delay之后任务就可以再次被取到，
+// bury是把任务转移到buried_stream中
+type redisQueue struct {
+  conf *RedisConf
+
+  mu   sync.Mutex
+  conn *respConn
+}
+
+func openRedisQueue(conf *RedisConf) (taskQueue, error) {
+  if conf.Consumer == "" {
+    conf.Consumer, _ = os.Hostname()
+  }
+  q := &redisQueue{conf: conf}
+  _, e := q.do("XGROUP", "CREATE", conf.ReserveStream, conf.Group, "0", "MKSTREAM")
+  if e != nil && !strings.HasPrefix(e.Error(), "BUSYGROUP") {
+    q.close()
+    return nil, e
+  }
+  return q, nil
+}
+
+// 执行命令，连接断开时下次执行会重新连接
+func (q *redisQueue) do(args ...string) (interface{}, error) {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if q.conn == nil {
+    conn, e := dialRESP(q.conf.Addr, q.conf.Password, q.conf.DB)
+    if e != nil {
+      return nil, e
+    }
+    q.conn = conn
+  }
+  v, e := q.conn.do(args...)
+  if _, ok := e.(respError); e != nil && !ok {
+    q.conn.close()
+    q.conn = nil
+  }
+  return v, e
+}
+
+func (q *redisQueue) ttr() int64 {
+  return int64(q.conf.TTR) * 1000
+}
+
+func (q *redisQueue) reserve() (*queueJob, error) {
+  // 先取超时的任务（其他Runner没处理完的或者nack的）
+  v, e := q.do("XAUTOCLAIM", q.conf.ReserveStream, q.conf.Group, q.conf.Consumer, strconv.FormatInt(q.ttr(), 10), "0-0", "COUNT", "1")
+  if e != nil {
+    return nil, e
+  }
+  if arr, ok := v.([]interface{}); ok && len(arr) >= 2 {
+    if entries, ok := arr[1].([]interface{}); ok {
+      for _, entry := range entries {
+        if j := parseStreamEntry(entry); j != nil {
+          j.attempts = q.deliveries(j)
+          return j, nil
+        }
+      }
+    }
+  }
+  args := []string{"XREADGROUP", "GROUP", q.conf.Group, q.conf.Consumer, "COUNT", "1"}
+  if q.conf.ReserveTimeout > 0 {
+    args = append(args, "BLOCK", strconv.Itoa(q.conf.ReserveTimeout*1000))
+  }
+  args = append(args, "STREAMS", q.conf.ReserveStream, ">")
+  v, e = q.do(args...)
+  if e != nil || v == nil {
+    return nil, e
+  }
+  // [[stream, [entry...]]]
+  streams, _ := v.([]interface{})
+  for _, s := range streams {
+    if arr, ok := s.([]interface{}); ok && len(arr) == 2 {
+      if entries, ok := arr[1].([]interface{}); ok {
+        for _, entry := range entries {
+          if j := parseStreamEntry(entry); j != nil {
+            j.attempts = 1
+            return j, nil
+          }
+        }
+      }
+    }
+  }
+  return nil, nil
+}
+
+// 任务被取到的次数（pending列表中的delivery count）
+func (q *redisQueue) deliveries(j *queueJob) int {
+  v, _ := q.do("XPENDING", q.conf.ReserveStream, q.conf.Group, j.id, j.id, "1")
+  if arr, _ := v.([]interface{}); len(arr) == 1 {
+    if info, _ := arr[0].([]interface{}); len(info) == 4 {
+      if n, _ := info[3].(int64); n > 0 {
+        return int(n)
+      }
+    }
+  }
+  return 1
+}
+
+// entry的格式是[id, [field, value, ...]]，已经删除的entry为nil
+func parseStreamEntry(entry interface{}) *queueJob {
+  arr, ok := entry.([]interface{})
+  if !ok || len(arr) != 2 {
+    return nil
+  }
+  id, _ := arr[0].([]byte)
+  fields, _ := arr[1].([]interface{})
+  for i := 0; i+1 < len(fields); i += 2 {
+    if k, _ := fields[i].([]byte); string(k) == "data" {
+      data, _ := fields[i+1].([]byte)
+      return &queueJob{id: string(id), data: data}
+    }
+  }
+  return nil
+}
+
+func (q *redisQueue) ack(j *queueJob) error {
+  _, e := q.do("XACK", q.conf.ReserveStream, q.conf.Group, j.id)
+  if e == nil {
+    _, e = q.do("XDEL", q.conf.ReserveStream, j.id)
+  }
+  return e
+}
+
+func (q *redisQueue) nack(j *queueJob, delay time.Duration) error {
+  idle := q.ttr() - int64(delay/time.Millisecond)
+  if idle < 0 {
+    idle = 0
+  }
+  return q.claim(j, idle)
+}
+
+func (q *redisQueue) touch(j *queueJob) error {
+  return q.claim(j, 0)
+}
+
+// 重新认领任务并设置空闲时间，任务已经被其他Runner取走时返回错误
+func (q *redisQueue) claim(j *queueJob, idle int64) error {
+  v, e := q.do("XPENDING", q.conf.ReserveStream, q.conf.Group, j.id, j.id, "1", q.conf.Consumer)
+  if e != nil {
+    return e
+  }
+  if arr, _ := v.([]interface{}); len(arr) == 0 {
+    return fmt.Errorf("job %s not pending", j.id)
+  }
+  _, e = q.do("XCLAIM", q.conf.ReserveStream, q.conf.Group, q.conf.Consumer, "0", j.id, "IDLE", strconv.FormatInt(idle, 10), "JUSTID")
+  return e
+}
+
+func (q *redisQueue) bury(j *queueJob) error {
+  if q.conf.BuriedStream != "" {
+    _, e := q.do("XADD", q.conf.BuriedStream, "*", "data", string(j.data), "id", j.id)
+    if e != nil {
+      return e
+    }
+  }
+  return q.ack(j)
+}
+
+func (q *redisQueue) requeue(j *queueJob, data []byte) error {
+  _, e := q.do("XADD", q.conf.ReserveStream, "*", "data", string(data))
+  if e != nil {
+    return e
+  }
+  return q.ack(j)
+}
+
+func (q *redisQueue) publish(data []byte) error {
+  _, e := q.do("XADD", q.conf.PutStream, "*", "data", string(data))
+  return e
+}
+
+func (q *redisQueue) discover(data []byte) error {
+  if q.conf.DiscoverStream == "" {
+    return errNoDiscover
+  }
+  _, e := q.do("XADD", q.conf.DiscoverStream, "*", "data", string(data))
+  return e
+}
+
+func (q *redisQueue) close() error {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if q.conn == nil {
+    return nil
+  }
+  e := q.conn.close()
+  q.conn = nil
+  return e
+}
+
+// Redis返回的错误（命令执行失败，连接仍然可用）
+type respError string
+
+func (e respError) Error() string {
+  return string(e)
+}
+
+// Redis协议（RESP2）的客户端，只实现了队列用到的部分，
+// 返回值：简单字符串为string，整数为int64，字符串为[]byte，数组为[]interface{}，空值为nil
+type respConn struct {
+  conn net.Conn
+  r    *bufio.Reader
+  w    *bufio.Writer
+}
+
+func dialRESP(addr, password string, db int) (*respConn, error) {
+  conn, e := net.DialTimeout("tcp", addr, time.Second*10)
+  if e != nil {
+    return nil, e
+  }
+  c := &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+  if password != "" {
+    _, e = c.do("AUTH", password)
+  }
+  if e == nil && db != 0 {
+    _, e = c.do("SELECT", strconv.Itoa(db))
+  }
+  if e != nil {
+    c.close()
+    return nil, e
+  }
+  return c, nil
+}
+
+func (c *respConn) do(args ...string) (interface{}, error) {
+  fmt.Fprintf(c.w, "*%d\r\n", len(args))
+  for _, arg := range args {
+    fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+  }
+  e := c.w.Flush()
+  if e != nil {
+    return nil, e
+  }
+  return c.read()
+}
+
+func (c *respConn) read() (interface{}, error) {
+  line, e := c.r.ReadString('\n')
+  if e != nil {
+    return nil, e
+  }
+  if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+    return nil, errors.New("invalid reply")
+  }
+  t, s := line[0], line[1:len(line)-2]
+  switch t {
+  case '+':
+    return s, nil
+  case '-':
+    return nil, respError(s)
+  case ':':
+    return strconv.ParseInt(s, 10, 64)
+  case '$':
+    n, e := strconv.Atoi(s)
+    if e != nil || n < 0 {
+      return nil, e
+    }
+    data := make([]byte, n+2)
+    _, e = io.ReadFull(c.r, data)
+    if e != nil {
+      return nil, e
+    }
+    return data[:n], nil
+  case '*':
+    n, e := strconv.Atoi(s)
+    if e != nil || n < 0 {
+      return nil, e
+    }
+    arr := make([]interface{}, n)
+    for i := range arr {
+      arr[i], e = c.read()
+      // 数组中的错误（如事务）作为元素返回，要读完整个数组
+      if re, ok := e.(respError); ok {
+        arr[i] = re
+      } else if e != nil {
+        return nil, e
+      }
+    }
+    return arr, nil
+  }
+  return nil, fmt.Errorf("invalid reply type %q", t)
+}
+
+func (c *respConn) close() error {
+  return c.conn.Close()
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+  "time"
+)
+
+// 每个队列都要通过的测试，put向取任务的队列添加任务，published和discovered返回提交的所有结果和新商品
+func testQueue(t *testing.T, q taskQueue, put func(data []byte), published, discovered func() [][]byte) {
+  defer q.close()
+  reserve := func(expect string) *queueJob {
+    t.Helper()
+    j, e := q.reserve()
+    if e != nil {
+      t.Fatal(e)
+    }
+    if expect == "" {
+      if j != nil {
+        t.Fatalf("expect no job, got %s", j.data)
+      }
+      return nil
+    }
+    if j == nil || string(j.data) != expect {
+      t.Fatalf("expect job %s, got %v", expect, j)
+    }
+    return j
+  }
+
+  reserve("")
+  put([]byte(`{"id":"a"}`))
+  put([]byte(`{"id":"b"}`))
+  a := reserve(`{"id":"a"}`)
+  if e := q.touch(a); e != nil {
+    t.Error(e)
+  }
+  b := reserve(`{"id":"b"}`)
+  reserve("")
+
+  // nack之后可以再次取到（ID不变）
+  if e := q.nack(a, 0); e != nil {
+    t.Fatal(e)
+  }
+  a2 := reserve(`{"id":"a"}`)
+  if a2.id != a.id || a.attempts != 1 || a2.attempts != 2 {
+    t.Errorf("expect id %s attempts 2, got %s attempts %d", a.id, a2.id, a2.attempts)
+  }
+
+  // delay之后才能取到
+  if e := q.nack(b, time.Second); e != nil {
+    t.Fatal(e)
+  }
+  reserve("")
+  time.Sleep(time.Millisecond * 1100)
+  b = reserve(`{"id":"b"}`)
+
+  // ack之后不能再操作
+  if e := q.ack(a2); e != nil {
+    t.Fatal(e)
+  }
+  if e := q.touch(a2); e == nil {
+    t.Error("expect touch to fail after ack")
+  }
+  if e := q.ack(b); e != nil {
+    t.Fatal(e)
+  }
+  reserve("")
+
+  // bury之后不会再被取到
+  put([]byte(`{"id":"c"}`))
+  c := reserve(`{"id":"c"}`)
+  if e := q.bury(c); e != nil {
+    t.Fatal(e)
+  }
+  reserve("")
+  if e := q.touch(c); e == nil {
+    t.Error("expect touch to fail after bury")
+  }
+
+  // requeue之后取到的是新的任务
+  put([]byte(`{"id":"d"}`))
+  d := reserve(`{"id":"d"}`)
+  if e := q.requeue(d, []byte(`{"id":"d2"}`)); e != nil {
+    t.Fatal(e)
+  }
+  d2 := reserve(`{"id":"d2"}`)
+  if d2.id == d.id || d2.attempts != 1 {
+    t.Errorf("expect new job, got %s attempts %d", d2.id, d2.attempts)
+  }
+  if e := q.ack(d2); e != nil {
+    t.Fatal(e)
+  }
+  reserve("")
+
+  for _, s := range []string{`{"id":"r1"}`, `{"id":"r2"}`} {
+    if e := q.publish([]byte(s)); e != nil {
+      t.Fatal(e)
+    }
+  }
+  expect := [][]byte{[]byte(`{"id":"r1"}`), []byte(`{"id":"r2"}`)}
+  if actual := published(); !reflect.DeepEqual(actual, expect) {
+    t.Errorf("expect published %q, got %q", expect, actual)
+  }
+
+  // 新商品提交到单独的队列，之后的结果仍然提交到原来的队列
+  if e := q.discover([]byte(`{"id":"n1"}`)); e != nil {
+    t.Fatal(e)
+  }
+  if e := q.publish([]byte(`{"id":"r3"}`)); e != nil {
+    t.Fatal(e)
+  }
+  if actual := discovered(); !reflect.DeepEqual(actual, [][]byte{[]byte(`{"id":"n1"}`)}) {
+    t.Errorf("expect discovered n1, got %q", actual)
+  }
+  if actual := published(); len(actual) != 3 {
+    t.Errorf("expect 3 published, got %q", actual)
+  }
+}
+
+func TestBeanstalkQueue(t *testing.T) {
+  fb := newFakeBeanstalkd(t)
+  defer fb.close()
+  conf := &BeanstalkConf{Host: "127.0.0.1", Port: fb.port(), ReserveTube: "dispatch", PutTube: "report", PutPriority: 1024, PutTTR: 60, Heartbeat: 1, DiscoverTube: "discover"}
+  q, e := openBeanstalkQueue(conf)
+  if e != nil {
+    t.Fatal(e)
+  }
+  testQueue(t, q, func(data []byte) {
+    fb.put("dispatch", data)
+  }, func() [][]byte {
+    return fb.bodies("report")
+  }, func() [][]byte {
+    return fb.bodies("discover")
+  })
+}
+
+// put_tube为空时结果提交到default，requeue之后也是
+func TestBeanstalkQueueDefaultTube(t *testing.T) {
+  fb := newFakeBeanstalkd(t)
+  defer fb.close()
+  conf := &BeanstalkConf{Host: "127.0.0.1", Port: fb.port(), ReserveTube: "dispatch", PutTTR: 60}
+  q, e := openBeanstalkQueue(conf)
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer q.close()
+  fb.put("dispatch", []byte(`{"id":"a"}`))
+  j, e := q.reserve()
+  if e != nil || j == nil {
+    t.Fatalf("expect job, got %v, %v", j, e)
+  }
+  if e := q.requeue(j, []byte(`{"id":"a2"}`)); e != nil {
+    t.Fatal(e)
+  }
+  if e := q.publish([]byte(`{"id":"r1"}`)); e != nil {
+    t.Fatal(e)
+  }
+  if actual := fb.bodies("default"); !reflect.DeepEqual(actual, [][]byte{[]byte(`{"id":"r1"}`)}) {
+    t.Errorf("expect r1 in default, got %q", actual)
+  }
+  if actual := fb.bodies("dispatch"); len(actual) != 1 || string(actual[0]) != `{"id":"a2"}` {
+    t.Errorf("expect only a2 in dispatch, got %q", actual)
+  }
+}
+
+func TestRedisQueue(t *testing.T) {
+  fr := newFakeRedis(t)
+  defer fr.close()
+  conf := &RedisConf{Addr: fr.addr(), ReserveStream: "dispatch", PutStream: "report", DiscoverStream: "discover", Group: "runner", TTR: 600}
+  q, e := openRedisQueue(conf)
+  if e != nil {
+    t.Fatal(e)
+  }
+  testQueue(t, q, func(data []byte) {
+    fr.add("dispatch", "data", string(data))
+  }, func() [][]byte {
+    return fr.values("report")
+  }, func() [][]byte {
+    return fr.values("discover")
+  })
+}
+
+// Runner崩溃（超过ttr没有touch）后，任务会被其他Runner取走
+func TestRedisQueueClaim(t *testing.T) {
+  fr := newFakeRedis(t)
+  defer fr.close()
+  conf1 := &RedisConf{Addr: fr.addr(), ReserveStream: "dispatch", PutStream: "report", Group: "runner", Consumer: "r1", TTR: 1}
+  conf2 := *conf1
+  conf2.Consumer = "r2"
+  q1, _ := openRedisQueue(conf1)
+  defer q1.close()
+  q2, e := openRedisQueue(&conf2)
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer q2.close()
+  fr.add("dispatch", "data", "x")
+  j, _ := q1.reserve()
+  if j == nil {
+    t.Fatal("expect job")
+  }
+  if j2, _ := q2.reserve(); j2 != nil {
+    t.Fatal("expect no job before ttr")
+  }
+  time.Sleep(time.Millisecond * 1100)
+  j2, _ := q2.reserve()
+  if j2 == nil || j2.id != j.id {
+    t.Fatalf("expect job %s to be claimed, got %v", j.id, j2)
+  }
+  if e := q1.touch(j); e == nil {
+    t.Error("expect touch to fail after claimed")
+  }
+}
+
+func TestFileQueue(t *testing.T) {
+  dir, e := ioutil.TempDir("", "queue")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  conf := &FileQueueConf{Reserve: filepath.Join(dir, "tasks.jsonl"), Put: filepath.Join(dir, "reports.jsonl"), Discover: filepath.Join(dir, "discover.jsonl")}
+  q, e := openFileQueue(conf)
+  if e != nil {
+    t.Fatal(e)
+  }
+  testQueue(t, q, func(data []byte) {
+    f, _ := os.OpenFile(conf.Reserve, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+    f.Write(append(data, '\n', '\n'))
+    f.Close()
+  }, func() [][]byte {
+    data, _ := ioutil.ReadFile(conf.Put)
+    return splitLines(data)
+  }, func() [][]byte {
+    data, _ := ioutil.ReadFile(conf.Discover)
+    return splitLines(data)
+  })
+}
+
+func splitLines(data []byte) [][]byte {
+  ret := make([][]byte, 0, 2)
+  start := 0
+  for i, b := range data {
+    if b == '\n' {
+      ret = append(ret, data[start:i])
+      start = i + 1
+    }
+  }
+  return ret
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+  "fmt"
+  "hash/fnv"
+  "os"
+  "os/signal"
+  "path/filepath"
+  "syscall"
+  "time"
+)
+
+// 重新加载规则，检查不通过时继续使用原来的规则，
+// 正在进行的抓取使用的是开始时的规则快照，不受影响
+func reloadRules() error {
+  e := LoadRules(Conf.Task.Rules)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: LoadRules, keep using the old rules")
+    return e
+  }
+  logger.Info().Msgf("reload rules, ok, %d rules", len(currentRules()))
+  return nil
+}
+
+// 收到SIGHUP或规则目录有变化（每隔task.rules_watch秒检查一次，0表示不检查）时重新加载规则
+func watchRules() {
+  dir := Conf.Task.Rules
+  hup := make(chan os.Signal, 1)
+  signal.Notify(hup, syscall.SIGHUP)
+  var tick <-chan time.Time
+  if Conf.Task.RulesWatch > 0 {
+    tick = time.NewTicker(time.Second * time.Duration(Conf.Task.RulesWatch)).C
+  }
+  last := fingerprint(dir)
+  for {
+    select {
+    case <-hup:
+      logger.Info().Msg("SIGHUP, reload rules")
+    case <-tick:
+      if fingerprint(dir) == last {
+        continue
+      }
+      logger.Info().Msg("rules changed, reload rules")
+    }
+    // 加载失败也更新，文件再次修改后才会重新加载
+    last = fingerprint(dir)
+    reloadRules()
+  }
+}
+
+// 根据目录下所有规则文件的路径、大小和修改时间计算的摘要
+func fingerprint(dir string) uint64 {
+  h := fnv.New64a()
+  filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+    if err != nil || path == dir {
+      return nil
+    }
+    if info.Name()[:1] == "." {
+      if info.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    ext := filepath.Ext(path)
+    if ext == ".yaml" || ext == ".yml" {
+      fmt.Fprintf(h, "%s|%d|%d\n", path, info.Size(), info.ModTime().UnixNano())
+    }
+    return nil
+  })
+  return h.Sum64()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestReloadRules(t *testing.T) {
+  dir, e := ioutil.TempDir("", "rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  data, _ := ioutil.ReadFile("rules/tmall.yaml")
+  ioutil.WriteFile(filepath.Join(dir, "tmall.yaml"), data, 0644)
+  old := Conf.Task.Rules
+  Conf.Task.Rules = dir
+  defer func() {
+    Conf.Task.Rules = old
+  }()
+
+  fp := fingerprint(dir)
+  if e := reloadRules(); e != nil {
+    t.Fatal(e)
+  }
+  snapshot := currentRules()
+  if len(snapshot) != 1 || snapshot.findRuleByURL("https://detail.tmall.com/item.htm?id=564998912180") == nil {
+    t.Fatal("tmall rule not loaded")
+  }
+
+  // 检查不通过时继续使用原来的规则
+  ioutil.WriteFile(filepath.Join(dir, "bad.yaml"), []byte("name: \"bad\"\nsource: 99\nmatch:\n  - \"(\"\n"), 0644)
+  if fingerprint(dir) == fp {
+    t.Error("fingerprint not changed")
+  }
+  if e := reloadRules(); e == nil {
+    t.Fatal("expect reload to fail")
+  }
+  if rs := currentRules(); len(rs) != 1 || rs[0] != snapshot[0] {
+    t.Error("old rules not kept")
+  }
+
+  os.Remove(filepath.Join(dir, "bad.yaml"))
+  data, _ = ioutil.ReadFile("rules/jingdong.yaml")
+  ioutil.WriteFile(filepath.Join(dir, "jingdong.yaml"), data, 0644)
+  if e := reloadRules(); e != nil {
+    t.Fatal(e)
+  }
+  if len(currentRules()) != 2 {
+    t.Error("new rules not loaded")
+  }
+  // 已经取到的快照不受影响
+  if len(snapshot) != 1 {
+    t.Error("snapshot changed")
+  }
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// 比较报告时忽略的字段（每次抓取都不一样）
+var replayIgnored = map[string]bool{"_id": true, "short_url": true, "update_time": true}
+
+// 重新处理reserve时dump的任务（log/dump/<日期>/<id>_reserve.json[.gz]），不连接任务队列，
+// 使用临时的store（不受crawl_duration去重影响，也不修改Runner的store），
+// 新的报告dump到-out目录，-compare时与reserve文件同目录下dump的报告逐个字段比较，有不一致时返回1
+func cmdReplay(args []string) int {
+  fs, conf := newFlagSet("replay", "<reserve.json>")
+  compare := fs.Bool("compare", false, "compare with the dumped reports next to the reserve file")
+  out := fs.String("out", "", "directory to dump the new reports (default a temporary directory)")
+  shorten := fs.Bool("shorten", false, "request short urls")
+  if fs.Parse(args) != nil || fs.NArg() != 1 {
+    fs.Usage()
+    return 2
+  }
+  file := fs.Arg(0)
+  t, e := readReport(file)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  if e = initCommand(*conf, true); e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer closeChrome()
+  dir := *out
+  if dir == "" {
+    dir, e = ioutil.TempDir("", "replay")
+    if e != nil {
+      fmt.Fprintln(os.Stderr, e)
+      return 1
+    }
+    defer os.RemoveAll(dir)
+  }
+  store, e = openStore(filepath.Join(dir, "replay.db"), time.Second)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  defer store.Close()
+  if !*shorten {
+    // 不请求短链接服务，short_url与url相同
+    shortener = func(addr string) string {
+      return addr
+    }
+  }
+  messages, products, e := replayTask(t, dir)
+  if e != nil {
+    fmt.Fprintln(os.Stderr, e)
+    return 1
+  }
+  printReport(os.Stdout, "messages", messages)
+  printReport(os.Stdout, "products", products)
+  if !*compare {
+    return 0
+  }
+  diffs := 0
+  for _, v := range []struct {
+    kind   string
+    report *Task
+  }{{"messages", messages}, {"products", products}} {
+    // 报告可能在第二天才提交，也要查找相邻的日期目录
+    name := fmt.Sprintf("%s_report_%s", t.ID, v.kind)
+    f := findDump(filepath.Dir(file), name)
+    if f == "" {
+      f = findDump(filepath.Dir(filepath.Dir(file)), name)
+    }
+    old, e := readReport(f)
+    if os.IsNotExist(e) && v.report == nil {
+      continue
+    }
+    if e != nil && !os.IsNotExist(e) {
+      fmt.Fprintln(os.Stderr, e)
+      return 1
+    }
+    for _, d := range compareReports(old, v.report) {
+      fmt.Printf("%s, %s\n", v.kind, d)
+      diffs++
+    }
+  }
+  fmt.Printf("%d difference(s)\n", diffs)
+  if diffs > 0 {
+    return 1
+  }
+  return 0
+}
+
+// 处理任务，报告dump到dir/dump（与Runner的dump相同，但不取样也不压缩），
+// 返回消息和商品的报告（没有时为nil），需要先初始化Chrome和store
+func replayTask(t *Task, dir string) (*Task, *Task, error) {
+  names := []string{t.ID + "_report_messages", t.ID + "_report_products"}
+  // 删除上次replay的报告
+  for _, name := range names {
+    for f := findDump(filepath.Join(dir, "dump"), name); f != ""; f = findDump(filepath.Join(dir, "dump"), name) {
+      if e := os.Remove(f); e != nil {
+        return nil, nil, e
+      }
+    }
+  }
+  oldQueue, oldLog := queue, Conf.Log
+  queue, Conf.Log.Dir, Conf.Log.Dump = replayQueue{}, dir, DumpConf{}
+  defer func() {
+    queue, Conf.Log = oldQueue, oldLog
+  }()
+  _, e := crawlTask(t)
+  if e != nil {
+    return nil, nil, e
+  }
+  reports := make([]*Task, len(names))
+  for i, name := range names {
+    f := findDump(filepath.Join(dir, "dump"), name)
+    if f == "" {
+      continue
+    }
+    reports[i], e = readReport(f)
+    if e != nil {
+      return nil, nil, e
+    }
+  }
+  return reports[0], reports[1], nil
+}
+
+// 在dir和dir下的日期目录中查找dump的文件（name.json或name.json.gz），没有时返回空字符串
+func findDump(dir, name string) string {
+  for _, pattern := range []string{name + ".json*", "*/" + name + ".json*"} {
+    arr, _ := filepath.Glob(filepath.Join(dir, pattern))
+    for _, f := range arr {
+      if strings.HasSuffix(f, ".json") || strings.HasSuffix(f, ".json.gz") {
+        return f
+      }
+    }
+  }
+  return ""
+}
+
+func readReport(file string) (*Task, error) {
+  if file == "" {
+    return nil, os.ErrNotExist
+  }
+  data, e := readDump(file)
+  if e != nil {
+    return nil, e
+  }
+  t := &Task{}
+  e = json.Unmarshal(data, t)
+  if e != nil {
+    return nil, fmt.Errorf("%s: %s", file, e)
+  }
+  return t, nil
+}
+
+func printReport(w io.Writer, kind string, t *Task) {
+  if t == nil {
+    return
+  }
+  fmt.Fprintf(w, "%s, %d payload(s), %d result(s)\n", kind, len(t.Payloads), len(t.Results))
+  for _, r := range t.Results {
+    id := r.ProductID
+    if r.MessageID != "" {
+      id = r.MessageID
+    }
+    if r.Field != "" {
+      fmt.Fprintf(w, "  %-11s %s (%s)\n", r.Status, id, r.Field)
+    } else {
+      fmt.Fprintf(w, "  %-11s %s\n", r.Status, id)
+    }
+  }
+}
+
+// 逐个字段比较两次报告（old为dump的报告，new为重新处理的报告），
+// 返回不一致的地方，如"product 31: price 5 -> 6"
+func compareReports(old, new *Task) []string {
+  a, b := reportEntries(old), reportEntries(new)
+  keys := make([]string, 0, len(a)+len(b))
+  for k := range a {
+    keys = append(keys, k)
+  }
+  for k := range b {
+    if _, ok := a[k]; !ok {
+      keys = append(keys, k)
+    }
+  }
+  sort.Strings(keys)
+  var ret []string
+  for _, k := range keys {
+    ea, ok1 := a[k]
+    eb, ok2 := b[k]
+    switch {
+    case !ok1:
+      ret = append(ret, k+": only in the new report")
+      continue
+    case !ok2:
+      ret = append(ret, k+": only in the dumped report")
+      continue
+    }
+    fields := make([]string, 0, len(ea)+len(eb))
+    for f := range ea {
+      fields = append(fields, f)
+    }
+    for f := range eb {
+      if _, ok := ea[f]; !ok {
+        fields = append(fields, f)
+      }
+    }
+    sort.Strings(fields)
+    for _, f := range fields {
+      va, ok1 := ea[f]
+      vb, ok2 := eb[f]
+      if ok1 && ok2 && va == vb {
+        continue
+      }
+      if !ok1 {
+        va = "(none)"
+      }
+      if !ok2 {
+        vb = "(none)"
+      }
+      ret = append(ret, fmt.Sprintf("%s: %s %s -> %s", k, f, va, vb))
+    }
+  }
+  return ret
+}
+
+// 报告中每个消息/商品的字段（商品的字段和结果的status、field，嵌套的字段展开为a.b），
+// key为"message <id>"或"product <id>"
+func reportEntries(t *Task) map[string]map[string]string {
+  ret := make(map[string]map[string]string, 16)
+  if t == nil {
+    return ret
+  }
+  entry := func(k string) map[string]string {
+    m := ret[k]
+    if m == nil {
+      m = make(map[string]string, 16)
+      ret[k] = m
+    }
+    return m
+  }
+  for _, p := range t.Payloads {
+    if p == nil || p.Product == nil {
+      continue
+    }
+    k := "product " + p.Product.ID
+    if p.Message != nil {
+      k = "message " + p.Message.ID
+    }
+    data, _ := json.Marshal(p.Product)
+    var v map[string]interface{}
+    json.Unmarshal(data, &v)
+    flatten(entry(k), "", v)
+  }
+  for _, r := range t.Results {
+    k := "product " + r.ProductID
+    if r.MessageID != "" {
+      k = "message " + r.MessageID
+    }
+    m := entry(k)
+    m["status"] = r.Status
+    if r.Field != "" {
+      m["field"] = r.Field
+    }
+  }
+  return ret
+}
+
+func flatten(m map[string]string, prefix string, v map[string]interface{}) {
+  for k, val := range v {
+    if prefix == "" && replayIgnored[k] {
+      continue
+    }
+    if sub, ok := val.(map[string]interface{}); ok {
+      flatten(m, prefix+k+".", sub)
+      continue
+    }
+    m[prefix+k] = fmt.Sprint(val)
+  }
+}
+
+// 不连接任何队列，提交的报告只dump到文件
+type replayQueue struct{}
+
+func (replayQueue) reserve() (*queueJob, error) {
+  return nil, nil
+}
+
+func (replayQueue) ack(j *queueJob) error {
+  return nil
+}
+
+func (replayQueue) nack(j *queueJob, delay time.Duration) error {
+  return nil
+}
+
+func (replayQueue) touch(j *queueJob) error {
+  return nil
+}
+
+func (replayQueue) bury(j *queueJob) error {
+  return nil
+}
+
+func (replayQueue) requeue(j *queueJob, data []byte) error {
+  return nil
+}
+
+func (replayQueue) publish(data []byte) error {
+  return nil
+}
+
+func (replayQueue) discover(data []byte) error {
+  return nil
+}
+
+func (replayQueue) close() error {
+  return nil
+}
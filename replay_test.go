@@ -0,0 +1,74 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "testing"
+)
+
+func TestReplay(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  _, restore := setupTestRules(t)
+  defer restore()
+  defer setupStore(t)()
+  fc.Evaluate = shopEvaluate
+  oldShortener := shortener
+  shortener = func(addr string) string {
+    return addr
+  }
+  defer func() {
+    shortener = oldShortener
+  }()
+  dir, e := ioutil.TempDir("", "replay")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+
+  task := &Task{ID: "t1", Payloads: []*Payload{
+    {Product: &Product{ID: "31", URL: "https://www.shop.test/item?id=31"}},
+    {Product: &Product{ID: "5", URL: "https://www.shop.test/list"}},
+  }}
+  oldQueue := queue
+  messages, products, e := replayTask(task, dir)
+  if e != nil {
+    t.Fatal(e)
+  }
+  if messages != nil || products == nil || len(products.Payloads) != 1 || len(products.Results) != 2 {
+    t.Fatalf("unexpected reports %v %v", messages, products)
+  }
+  if queue != oldQueue {
+    t.Error("expect queue restored")
+  }
+  if diffs := compareReports(products, products); len(diffs) != 0 {
+    t.Errorf("expect no difference, got %v", diffs)
+  }
+
+  // 模拟dump的报告：价格和标题不一样，多一个商品
+  data, _ := json.Marshal(products)
+  old := &Task{}
+  json.Unmarshal(data, old)
+  old.Payloads[0].Product.Price = 30
+  old.Payloads[0].Product.Title = ""
+  old.Payloads[0].Product.ShortURL = "https://t.cn/x"
+  old.Results = append(old.Results, &Result{ProductID: "9", Status: statusOK})
+  data, _ = json.Marshal(old)
+  file := filepath.Join(dir, "t1_report_products.json")
+  ioutil.WriteFile(file, data, 0644)
+  old, e = readReport(file)
+  if e != nil {
+    t.Fatal(e)
+  }
+  expect := []string{
+    "product 31: price 30 -> 31",
+    "product 31: title (none) -> item 31",
+    "product 9: only in the dumped report",
+  }
+  if diffs := compareReports(old, products); !reflect.DeepEqual(diffs, expect) {
+    t.Errorf("unexpected differences %v", diffs)
+  }
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+  "fmt"
+  "time"
+)
+
+// 抓取失败的原因
+type failKind string
+
+const (
+  // 消息中提取不到链接
+  failNoURL failKind = "no_url"
+
+  // 没有匹配的规则（不支持的网站）
+  failUnsupported failKind = "unsupported"
+
+  // 链接中匹配不到商品ID
+  failNoID failKind = "no_id"
+
+  // 标签页不可用（创建失败、连接断开或无响应）
+  failTab failKind = "tab"
+
+  // 页面加载超时并且没抓到价格
+  failTimeout failKind = "timeout"
+
+  // 没抓到价格（表达式有错、选择器不匹配或解析有错）
+  failExtract failKind = "extract"
+
+  // 链接中指定的SKU不能选中（如已售完）或没抓到价格
+  failSKU failKind = "sku"
+
+  // 抓到的商品ID与任务中的不一致
+  failIDMismatch failKind = "id_mismatch"
+)
+
+// 一次抓取的结果，
+// 失败时Kind是失败的原因，Field是失败的阶段、字段或脚本名（如navigate、price）
+type crawlResult struct {
+  // 标准URL
+  URL string
+
+  // 原始链接中指定的SKU
+  SKU string
+
+  // 抓到的商品，失败时也不为nil（可能只有部分字段）
+  Product *Product
+
+  Kind  failKind
+  Field string
+
+  // 没抓到值的字段（不影响结果，如库存、销量）
+  Missing []string
+
+  // 页面加载的时间（从打开链接开始）和整个抓取的时间
+  Load    time.Duration
+  Elapsed time.Duration
+
+  // 不为nil时记录每个脚本的结果（用于调试规则，crawl命令）
+  Scripts []*scriptTrace
+}
+
+type scriptTrace struct {
+  Name  string `json:"name"`
+  Async bool   `json:"async,omitempty"`
+
+  // 脚本返回的值和经过extract处理后的值
+  Raw   string `json:"raw"`
+  Value string `json:"value"`
+
+  Elapsed int64 `json:"elapsed_ms"`
+}
+
+func (r *crawlResult) trace(v *script, raw, value string, start time.Time) {
+  if r.Scripts != nil {
+    r.Scripts = append(r.Scripts, &scriptTrace{Name: v.Name, Async: v.Async, Raw: raw, Value: value, Elapsed: int64(time.Since(start) / time.Millisecond)})
+  }
+}
+
+// 单独抓取一个链接（admin的crawl接口和crawl命令）时输出的结果
+type crawlReport struct {
+  URL     string         `json:"url"`
+  Status  string         `json:"status"`
+  Field   string         `json:"field,omitempty"`
+  Missing []string       `json:"missing,omitempty"`
+  Load    int64          `json:"load_ms"`
+  Elapsed int64          `json:"elapsed_ms"`
+  Scripts []*scriptTrace `json:"scripts,omitempty"`
+  Product *Product       `json:"product,omitempty"`
+}
+
+func (r *crawlResult) report() *crawlReport {
+  ret := &crawlReport{
+    URL:     r.URL,
+    Status:  r.result(1).Status,
+    Field:   r.Field,
+    Missing: r.Missing,
+    Load:    int64(r.Load / time.Millisecond),
+    Elapsed: int64(r.Elapsed / time.Millisecond),
+    Scripts: r.Scripts,
+  }
+  if r.Product.ID != "" {
+    ret.Product = r.Product
+  }
+  return ret
+}
+
+func newCrawlResult(addr string) *crawlResult {
+  return &crawlResult{URL: addr, Product: NewProduct()}
+}
+
+func (r *crawlResult) fail(kind failKind, field string) *crawlResult {
+  r.Kind, r.Field = kind, field
+  return r
+}
+
+func (r *crawlResult) ok() bool {
+  return r.Kind == ""
+}
+
+// 重试有没有可能成功，链接和规则的问题重试也不会成功
+func (r *crawlResult) retryable() bool {
+  switch r.Kind {
+  case "", failNoURL, failUnsupported, failNoID:
+    return false
+  }
+  return true
+}
+
+const (
+  // 抓到了
+  statusOK = "ok"
+
+  // 在crawl_duration内已经抓过
+  statusSkipped = "skipped"
+)
+
+// 报告给Dispatcher的结果，失败时Status是失败的原因
+func (r *crawlResult) result(attempts int) *Result {
+  ret := &Result{Status: string(r.Kind), Field: r.Field, Attempts: attempts}
+  if r.ok() {
+    ret.Status = statusOK
+    ret.ProductID = r.Product.ID
+  }
+  return ret
+}
+
+func (r *crawlResult) String() string {
+  if r.ok() {
+    return fmt.Sprintf("%s ok, load %v, elapsed %v", r.URL, r.Load, r.Elapsed)
+  }
+  if r.Field == "" {
+    return fmt.Sprintf("%s %s, load %v, elapsed %v", r.URL, r.Kind, r.Load, r.Elapsed)
+  }
+  return fmt.Sprintf("%s %s(%s), load %v, elapsed %v", r.URL, r.Kind, r.Field, r.Load, r.Elapsed)
+}
+
+// 检查规则中的每个脚本是否抓到了值，
+// 没抓到价格算失败（页面加载超时的算超时），其他字段只记录在Missing中
+func (r *crawlResult) check(rule *rule) {
+  p := r.Product
+  for _, v := range rule.Scripts {
+    if v.Async {
+      continue
+    }
+    missing := false
+    switch v.Name {
+    case "title":
+      missing = p.Title == ""
+    case "price":
+      if p.Price == NoValue || (p.Price == RangePrice && p.PriceLow == 0 && p.PriceHigh == 0) {
+        kind := failExtract
+        if Conf.Task.CrawlTimeout > 0 && r.Load >= time.Second*time.Duration(Conf.Task.CrawlTimeout) {
+          kind = failTimeout
+        }
+        r.fail(kind, v.Name)
+        metricExtractFailures.inc(rule.Name, v.Name)
+      }
+    case "stock":
+      missing = p.Stock == NoValue
+    case "sales":
+      missing = p.Sales == NoValue
+    case "category":
+      missing = p.Category == ""
+    case "comments":
+      missing = p.Comments.Total == NoValue
+    default:
+      if v.Type != "" {
+        _, ok := p.Attributes[v.Name]
+        missing = !ok
+      }
+    }
+    metricExtract.inc(rule.Name, v.Name)
+    if missing {
+      r.Missing = append(r.Missing, v.Name)
+      metricExtractFailures.inc(rule.Name, v.Name)
+    }
+  }
+}
@@ -1,25 +1,56 @@
 package main
 
 import (
+  "crypto/sha1"
+  "fmt"
   "io/ioutil"
   "os"
   "path/filepath"
   "regexp"
+  "strconv"
+  "strings"
+  "sync/atomic"
 
   "gopkg.in/yaml.v2"
 )
 
-var Rules []*rule
+// 当前使用的规则（ruleSet），重新加载时整体替换，
+// 每次抓取开始时通过currentRules取一个快照，抓取过程中不受重新加载的影响
+var activeRules atomic.Value
+
+type ruleSet []*rule
+
+func currentRules() ruleSet {
+  rs, _ := activeRules.Load().(ruleSet)
+  return rs
+}
 
 type rule struct {
+  // 规则文件的路径
+  File string `yaml:"-"`
+
+  // 规则文件内容的摘要（sha1的前8位），用于确认Runner使用的是哪个版本的规则
+  Version string `yaml:"-"`
+
   Name       string           `yaml:"name"`
   Source     int              `yaml:"source"`
   Currency   int              `yaml:"currency"`
+  Locale     *locale          `yaml:"locale"`
   Match      []string         `yaml:"match"`
   MatchRegex []*regexp.Regexp `yaml:"-"`
   Chain      []*chain         `yaml:"chain"`
   ID         *id              `yaml:"id"`
   Scripts    []*script        `yaml:"scripts"`
+
+  // 按SKU抓取（可选）
+  SKU *skuConf `yaml:"sku"`
+
+  // 发现新商品的脚本名（type必须是urls），task.discover.budget大于0时，
+  // 脚本得到的链接中没有抓过的商品会提交到发现队列
+  Discover string `yaml:"discover"`
+
+  // 对该站点的抓取限制，没有配置的字段使用task.politeness
+  Politeness *PolitenessConf `yaml:"politeness"`
 }
 
 type chain struct {
@@ -45,11 +76,92 @@ type script struct {
   Script string `yaml:"script"`
   Async  bool   `yaml:"async"`
   Sleep  int    `yaml:"sleep"`
+
+  // 不是商品字段的脚本，声明了类型后结果保存在Product.Attributes中，
+  // 可选string、int、float、json、urls
+  Type string `yaml:"type"`
+
+  // 声明式的提取规则，和Script二选一
+  Extract *extractor `yaml:"extract"`
+  Plan    *plan      `yaml:"-"`
+}
+
+// 规则中的一个问题，Field是出问题的字段（如chain[0].index）
+type ruleProblem struct {
+  File  string
+  Field string
+  Msg   string
+
+  // 警告不影响规则的加载和使用（如未知的脚本名称，只是脚本的结果会被忽略）
+  Warn bool
+}
+
+func (p *ruleProblem) String() string {
+  level := "error"
+  if p.Warn {
+    level = "warning"
+  }
+  if p.Field == "" {
+    return fmt.Sprintf("%s: %s: %s", p.File, level, p.Msg)
+  }
+  return fmt.Sprintf("%s: %s: %s: %s", p.File, level, p.Field, p.Msg)
+}
+
+// 加载规则时发现的错误（不包括警告）
+type ruleErrors []*ruleProblem
+
+func (e ruleErrors) Error() string {
+  arr := make([]string, 0, len(e)+1)
+  arr = append(arr, fmt.Sprintf("%d error(s) in rules:", len(e)))
+  for _, p := range e {
+    arr = append(arr, "  "+p.String())
+  }
+  return strings.Join(arr, "\n")
+}
+
+// 规则中已知的脚本名称，其他名称的同步脚本没有声明type时结果会被忽略
+var knownScripts = map[string]bool{
+  "title":    true,
+  "price":    true,
+  "stock":    true,
+  "sales":    true,
+  "category": true,
+  "comments": true,
+}
+
+// 附加字段（Product.Attributes）的类型
+var attributeTypes = map[string]bool{
+  "string": true,
+  "int":    true,
+  "float":  true,
+  "json":   true,
+  "urls":   true,
 }
 
 func LoadRules(dir string) error {
-  Rules = make([]*rule, 0, 10)
-  return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+  rules, problems := loadRules(dir)
+  errs := make(ruleErrors, 0, len(problems))
+  for _, p := range problems {
+    if !p.Warn {
+      errs = append(errs, p)
+    }
+  }
+  if len(errs) > 0 {
+    return errs
+  }
+  activeRules.Store(ruleSet(rules))
+  return nil
+}
+
+// 加载并检查目录（包括子目录）下所有的规则，
+// 有错误的规则不会出现在返回的规则中
+func loadRules(dir string) ([]*rule, []*ruleProblem) {
+  rules := make([]*rule, 0, 10)
+  problems := make([]*ruleProblem, 0, 4)
+  e := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+    if err != nil {
+      return err
+    }
     if path == dir {
       return nil
     }
@@ -61,40 +173,264 @@ func LoadRules(dir string) error {
     }
     ext := filepath.Ext(path)
     if ext == ".yaml" || ext == ".yml" {
-      r, e := loadRule(path)
-      if e != nil {
-        return e
+      r, arr := loadRule(path)
+      problems = append(problems, arr...)
+      if r != nil {
+        rules = append(rules, r)
       }
-      Rules = append(Rules, r)
     }
     return nil
   })
+  if e != nil {
+    problems = append(problems, &ruleProblem{File: dir, Msg: e.Error()})
+  }
+  return rules, append(problems, checkRules(rules)...)
+}
+
+// 检查规则之间的冲突
+func checkRules(rules []*rule) []*ruleProblem {
+  ret := make([]*ruleProblem, 0, 2)
+  sources := make(map[int]*rule, len(rules))
+  names := make(map[string]*rule, len(rules))
+  for i, r := range rules {
+    if o, ok := sources[r.Source]; ok {
+      ret = append(ret, &ruleProblem{File: r.File, Field: "source", Msg: fmt.Sprintf("duplicate source %d (also in %s)", r.Source, o.File)})
+    } else {
+      sources[r.Source] = r
+    }
+    if o, ok := names[r.Name]; ok {
+      ret = append(ret, &ruleProblem{File: r.File, Field: "name", Msg: fmt.Sprintf("duplicate name %q (also in %s)", r.Name, o.File)})
+    } else {
+      names[r.Name] = r
+    }
+    // findRuleByURL使用第一个匹配的规则，如果一个规则的match能匹配另一个规则的match，
+    // 另一个规则的链接可能会被这个规则处理
+    for _, o := range rules[:i] {
+      for m, re := range r.MatchRegex {
+        for n, ore := range o.MatchRegex {
+          if re.MatchString(o.Match[n]) || ore.MatchString(r.Match[m]) {
+            ret = append(ret, &ruleProblem{File: r.File, Field: fmt.Sprintf("match[%d]", m), Msg: fmt.Sprintf("%q overlaps %q in %s", r.Match[m], o.Match[n], o.File)})
+          }
+        }
+      }
+    }
+  }
+  return ret
 }
 
-func loadRule(file string) (*rule, error) {
+// 加载并检查一个规则文件，有错误时返回的规则为nil
+func loadRule(file string) (*rule, []*ruleProblem) {
+  problems := make([]*ruleProblem, 0, 2)
+  fail := func(field, format string, args ...interface{}) {
+    problems = append(problems, &ruleProblem{File: file, Field: field, Msg: fmt.Sprintf(format, args...)})
+  }
+  warn := func(field, format string, args ...interface{}) {
+    problems = append(problems, &ruleProblem{File: file, Field: field, Msg: fmt.Sprintf(format, args...), Warn: true})
+  }
+  compile := func(field, expr string) *regexp.Regexp {
+    if expr == "" {
+      fail(field, "empty regex")
+      return nil
+    }
+    re, e := regexp.Compile(expr)
+    if e != nil {
+      fail(field, "%s", e)
+    }
+    return re
+  }
+
   data, e := ioutil.ReadFile(file)
   if e != nil {
-    return nil, e
+    fail("", "%s", e)
+    return nil, problems
   }
-  ret := &rule{}
+  ret := &rule{File: file, Version: fmt.Sprintf("%x", sha1.Sum(data))[:8]}
   e = yaml.Unmarshal(data, ret)
   if e != nil {
-    return nil, e
+    fail("", "%s", e)
+    return nil, problems
+  }
+
+  if ret.Name == "" {
+    fail("name", "missing")
+  }
+  if ret.Source <= Unknown {
+    fail("source", "missing or invalid (%d)", ret.Source)
+  }
+  if ret.Currency < 0 || ret.Currency > 4 {
+    fail("currency", "invalid (%d)", ret.Currency)
+  }
+  if ret.Locale != nil {
+    if e := ret.Locale.compile(); e != nil {
+      fail("locale", "%s", e)
+    }
+  }
+  if len(ret.Match) == 0 {
+    fail("match", "missing")
   }
   ret.MatchRegex = make([]*regexp.Regexp, len(ret.Match))
   for i, m := range ret.Match {
-    ret.MatchRegex[i] = regexp.MustCompile(m)
+    ret.MatchRegex[i] = compile(fmt.Sprintf("match[%d]", i), m)
+  }
+
+  for i, c := range ret.Chain {
+    field := fmt.Sprintf("chain[%d]", i)
+    if len(c.Match) == 0 {
+      fail(field+".match", "missing")
+    }
+    c.MatchRegex = make([]*regexp.Regexp, len(c.Match))
+    for j, m := range c.Match {
+      c.MatchRegex[j] = compile(fmt.Sprintf("%s.match[%d]", field, j), m)
+    }
+    if c.Index == "" && c.Script == "" {
+      fail(field, "neither index nor script")
+    }
+    if c.Index != "" {
+      c.IndexRegex = compile(field+".index", c.Index)
+      if c.IndexRegex != nil {
+        checkTemplate(c, field, fail)
+      }
+    }
+    if c.Script != "" && c.ScriptTemplate == "" {
+      fail(field+".script_template", "missing (script is set)")
+    }
+  }
+
+  if ret.ID == nil {
+    fail("id", "missing")
+  } else {
+    if len(ret.ID.Match) == 0 {
+      fail("id.match", "missing")
+    }
+    ret.ID.MatchRegex = make([]*regexp.Regexp, len(ret.ID.Match))
+    for i, m := range ret.ID.Match {
+      re := compile(fmt.Sprintf("id.match[%d]", i), m)
+      ret.ID.MatchRegex[i] = re
+      if re != nil && (ret.ID.Index < 0 || ret.ID.Index > re.NumSubexp()) {
+        fail("id.index", "%d out of range, id.match[%d] has %d group(s)", ret.ID.Index, i, re.NumSubexp())
+      }
+    }
+  }
+
+  if len(ret.Scripts) == 0 {
+    warn("scripts", "no scripts")
+  }
+  for i, s := range ret.Scripts {
+    field := fmt.Sprintf("scripts[%d]", i)
+    if s.Name == "" {
+      fail(field+".name", "missing")
+    } else {
+      field = fmt.Sprintf("scripts[%d](%s)", i, s.Name)
+    }
+    // 异步脚本的结果本来就会被忽略（如滚动、点击），不检查名称
+    if s.Name != "" && !s.Async && !knownScripts[s.Name] && s.Type == "" {
+      warn(field+".name", "unknown script name without type, result is ignored")
+    }
+    switch {
+    case s.Type == "":
+    case !attributeTypes[s.Type]:
+      fail(field+".type", "unknown type %q", s.Type)
+    case s.Async:
+      fail(field+".type", "async script has no result")
+    case knownScripts[s.Name]:
+      fail(field+".type", "not allowed for product field")
+    }
+    if s.Sleep < 0 {
+      fail(field+".sleep", "negative")
+    }
+    switch {
+    case s.Extract != nil && s.Script != "":
+      fail(field, "script and extract are exclusive")
+    case s.Extract != nil:
+      s.Plan, e = s.Extract.compile()
+      if e != nil {
+        fail(field+".extract", "%s", e)
+      }
+    case s.Script == "":
+      fail(field, "neither script nor extract")
+    }
   }
-  for _, c := range ret.Chain {
+
+  if ret.SKU != nil {
+    c := ret.SKU
+    if c.List == "" {
+      fail("sku.list", "missing")
+    }
+    if c.Select == "" {
+      fail("sku.select", "missing")
+    }
+    if c.Sleep < 0 || c.Max < 0 {
+      fail("sku", "negative value")
+    }
     c.MatchRegex = make([]*regexp.Regexp, len(c.Match))
     for i, m := range c.Match {
-      c.MatchRegex[i] = regexp.MustCompile(m)
+      re := compile(fmt.Sprintf("sku.match[%d]", i), m)
+      c.MatchRegex[i] = re
+      if re != nil && re.NumSubexp() == 0 {
+        fail(fmt.Sprintf("sku.match[%d]", i), "no group for sku id")
+      }
+    }
+  }
+
+  if ret.Discover != "" {
+    var s *script
+    for _, v := range ret.Scripts {
+      if v.Name == ret.Discover {
+        s = v
+      }
+    }
+    switch {
+    case s == nil:
+      fail("discover", "script %q not found", ret.Discover)
+    case s.Type != "urls":
+      fail("discover", "script %q is not of type urls", ret.Discover)
+    }
+  }
+
+  if p := ret.Politeness; p != nil && (p.Interval < 0 || p.Jitter < 0 || p.Concurrency < 0) {
+    fail("politeness", "negative value")
+  }
+
+  for _, p := range problems {
+    if !p.Warn {
+      return nil, problems
     }
-    c.IndexRegex = regexp.MustCompile(c.Index)
   }
-  ret.ID.MatchRegex = make([]*regexp.Regexp, len(ret.ID.Match))
-  for i, m := range ret.ID.Match {
-    ret.ID.MatchRegex[i] = regexp.MustCompile(m)
+  return ret, problems
+}
+
+// 检查chain的index_count和template，
+// FindStringSubmatchIndex返回的长度是(分组数+1)*2，
+// template中的变量（$1、${1}、$name、${name}）必须有对应的分组
+func checkTemplate(c *chain, field string, fail func(string, string, ...interface{})) {
+  n := c.IndexRegex.NumSubexp()
+  if c.IndexCount != (n+1)*2 {
+    fail(field+".index_count", "%d does not fit index with %d group(s), should be %d", c.IndexCount, n, (n+1)*2)
+  }
+  if c.Template == "" {
+    fail(field+".template", "missing")
+    return
+  }
+  groups := make(map[string]bool, n*2)
+  for i, name := range c.IndexRegex.SubexpNames() {
+    if i == 0 {
+      continue
+    }
+    groups[strconv.Itoa(i)] = true
+    if name != "" {
+      groups[name] = true
+    }
+  }
+  for _, arr := range templateVarRegex.FindAllStringSubmatch(c.Template, -1) {
+    name := arr[1] + arr[2]
+    if name == "$" {
+      continue
+    }
+    if !groups[name] {
+      fail(field+".template", "variable $%s has no matching group in index", name)
+    }
   }
-  return ret, nil
 }
+
+// template中的变量，与regexp.Expand的规则一致，$$表示$本身
+var templateVarRegex = regexp.MustCompile(`\$(?:\{([^}]*)\}|(\$|[a-zA-Z0-9_]+))`)
@@ -0,0 +1,242 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestLoadRules(t *testing.T) {
+  _, problems := loadRules("rules")
+  for _, p := range problems {
+    if !p.Warn {
+      t.Error(p)
+    }
+  }
+}
+
+func TestValidateRules(t *testing.T) {
+  dir, e := ioutil.TempDir("", "rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  files := map[string]string{
+    "a.yaml": `
+name: "a"
+source: 1
+match:
+  - "a.com"
+  - "b(.com"
+chain:
+  - match:
+      - "m.a.com"
+    index: "id=(\\d+)"
+    index_count: 6
+    template: "https://a.com/$1/$2/${name}"
+id:
+  match:
+    - "id=(\\d+)"
+  index: 2
+scripts:
+  - name: "title"
+    script: "document.title"
+  - name: "brand"
+    script: "document.title"
+  - name: "price"
+  - name: "seller"
+    type: "text"
+    script: "document.title"
+  - name: "stock"
+    type: "int"
+    script: "document.title"
+  - name: "coupon"
+    type: "string"
+    script: "document.title"
+discover: "brand"
+`,
+    "b.yaml": `
+name: "b"
+source: 1
+locale:
+  decimal: ","
+match:
+  - "www.a.com"
+scripts:
+  - name: "title"
+    extract:
+      selectors: ["h1"]
+      transforms:
+        - upper
+sku:
+  match:
+    - "skuId=\\d+"
+  list: "LIST"
+`,
+    "c.yaml": "name: [",
+  }
+  for name, content := range files {
+    if e := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); e != nil {
+      t.Fatal(e)
+    }
+  }
+  rules, problems := loadRules(dir)
+  if len(rules) != 0 {
+    t.Errorf("expect no valid rules, got %d", len(rules))
+  }
+  expects := []string{
+    "a.yaml: error: match[1]:",
+    "a.yaml: error: chain[0].index_count: 6",
+    "a.yaml: error: chain[0].template: variable $2",
+    "a.yaml: error: chain[0].template: variable $name",
+    "a.yaml: error: id.index: 2",
+    "a.yaml: warning: scripts[1](brand).name: unknown script name",
+    "a.yaml: error: scripts[2](price): neither script nor extract",
+    "a.yaml: error: scripts[3](seller).type: unknown type \"text\"",
+    "a.yaml: error: scripts[4](stock).type: not allowed",
+    "a.yaml: error: discover: script \"brand\" is not of type urls",
+    "b.yaml: error: locale: decimal and thousands are the same",
+    "b.yaml: error: id: missing",
+    "b.yaml: error: scripts[0](title).extract: transform \"upper\"",
+    "b.yaml: error: sku.select: missing",
+    "b.yaml: error: sku.match[0]: no group for sku id",
+    "c.yaml: error: yaml:",
+  }
+  all := make([]string, len(problems))
+  for i, p := range problems {
+    all[i] = strings.TrimPrefix(p.String(), dir+string(filepath.Separator))
+  }
+  for _, s := range all {
+    if strings.Contains(s, "(coupon)") {
+      t.Errorf("unexpected problem %q", s)
+    }
+  }
+  for _, expect := range expects {
+    found := false
+    for _, s := range all {
+      if strings.HasPrefix(s, expect) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      t.Errorf("expect %q in:\n%s", expect, strings.Join(all, "\n"))
+    }
+  }
+  if e := LoadRules(dir); e == nil {
+    t.Error("expect LoadRules to fail")
+  }
+}
+
+func TestCheckRules(t *testing.T) {
+  rules := make([]*rule, 0, 2)
+  for _, file := range []string{"rules/amazon_cn.yaml", "rules/tmall.yaml"} {
+    r, _ := loadRule(file)
+    if r == nil {
+      t.Fatalf("load %s failed", file)
+    }
+    rules = append(rules, r)
+  }
+  if problems := checkRules(rules); len(problems) != 0 {
+    t.Errorf("expect no problems, got %v", problems)
+  }
+  rules[1].Source = rules[0].Source
+  rules[1].Match = append(rules[1].Match, "www.amazon.cn")
+  rules[1].MatchRegex = append(rules[1].MatchRegex, rules[0].MatchRegex[0])
+  if problems := checkRules(rules); len(problems) != 2 {
+    t.Errorf("expect 2 problems, got %v", problems)
+  }
+}
+
+// 不需要Chrome：检查各站点规则的链接转换和价格处理
+func TestSiteRules(t *testing.T) {
+  rules, _ := loadRules("rules")
+  rs := ruleSet(rules)
+  urls := []struct {
+    addr   string
+    rule   string
+    expect string
+  }{
+    {"https://www.amazon.co.jp/Anker-PowerCore/dp/B019GNUT0C/ref=sr_1_1?keywords=anker", "amazon_jp", "https://www.amazon.co.jp/dp/B019GNUT0C"},
+    {"https://www.amazon.co.jp/gp/aw/d/B019GNUT0C?psc=1", "amazon_jp", "https://www.amazon.co.jp/dp/B019GNUT0C"},
+    {"https://www.amazon.co.jp/exec/obidos/ASIN/4873118468", "amazon_jp", "https://www.amazon.co.jp/dp/4873118468"},
+    {"https://www.amazon.com/gp/product/B0194WDVHI/", "amazon_us", "https://www.amazon.com/dp/B0194WDVHI"},
+    {"https://smile.amazon.com/o/ASIN/B0194WDVHI#reviews", "amazon_us", "https://www.amazon.com/dp/B0194WDVHI"},
+    {"https://www.amazon.co.uk/Anker-PowerCore/dp/B019GJLER8?th=1", "amazon_en", "https://www.amazon.co.uk/dp/B019GJLER8"},
+    {"https://www.amazon.de/-/en/dp/B08F9R7K4S/ref=twister", "amazon_de", "https://www.amazon.de/dp/B08F9R7K4S"},
+    {"https://www.amazon.cn/dp/B06XKCV7X9", "amazon_cn", ""},
+    {"https://m.you.163.com/item/detail?id=1006013&_stat_area=mod_1", "yanxuan", "https://you.163.com/item/detail?id=1006013"},
+    {"https://m.xiaomiyoupin.com/detail?gid=101893&spmref=share", "youpin", "https://www.xiaomiyoupin.com/detail?gid=101893"},
+    {"https://youpin.mi.com/detail?gid=101893", "youpin", "https://www.xiaomiyoupin.com/detail?gid=101893"},
+    {"https://www.amazon.com.au/dp/B0194WDVHI", "", ""},
+    {"https://www.amazon.de.example.com/dp/B08F9R7K4S", "", ""},
+    {"https://www.amazonaco.jp/dp/B019GNUT0C", "", ""},
+    {"https://www.amazon-co-uk.example.com/dp/B019GJLER8", "", ""},
+  }
+  for _, c := range urls {
+    r, ch := rs.findChainByURL(c.addr)
+    name := ""
+    if r != nil {
+      name = r.Name
+    }
+    if name != c.rule {
+      t.Errorf("%s: expect rule %q, got %q", c.addr, c.rule, name)
+      continue
+    }
+    if addr := matchURLFromChain(c.addr, ch); addr != c.expect {
+      t.Errorf("%s: expect %q, got %q", c.addr, c.expect, addr)
+    }
+    if c.expect != "" && matchIDFromRule(c.expect, r) == "" {
+      t.Errorf("%s: no id", c.expect)
+    }
+  }
+
+  prices := []struct {
+    rule   string
+    value  string
+    expect []float64
+  }{
+    {"amazon_jp", "￥2,599", []float64{2599}},
+    {"amazon_jp", "￥ 2,599 - ￥ 3,299（税込）", []float64{2599, 3299}},
+    {"amazon_us", "$25.99", []float64{25.99}},
+    {"amazon_us", "$1,025.99 - $1,235.00", []float64{1025.99, 1235}},
+    {"amazon_en", "£21.99", []float64{21.99}},
+    {"amazon_de", "21,99 €", []float64{21.99}},
+    {"amazon_de", "1.234,56 €", []float64{1234.56}},
+    {"amazon_de", "EUR 21,99", []float64{21.99}},
+    {"amazon_de", "21,99 € - 29,99 €", []float64{21.99, 29.99}},
+    {"yanxuan", "¥59-79", []float64{59, 79}},
+    {"youpin", "¥ 1,099", []float64{1099}},
+  }
+  for _, c := range prices {
+    var r *rule
+    for _, v := range rules {
+      if v.Name == c.rule {
+        r = v
+      }
+    }
+    if r == nil {
+      t.Fatalf("rule %s not found", c.rule)
+    }
+    for _, s := range r.Scripts {
+      if s.Name != "price" || s.Plan == nil {
+        continue
+      }
+      data, _ := json.Marshal([]string{c.value})
+      v := s.Plan.apply(string(data))
+      if arr := r.Locale.parsePrice(v); !reflect.DeepEqual(arr, c.expect) {
+        t.Errorf("%s %q: expect %v, got %v (%q)", c.rule, c.value, c.expect, arr, v)
+      }
+    }
+  }
+  currencies := map[string]int{"amazon_jp": 1, "amazon_us": 2, "amazon_en": 3, "amazon_de": 4, "yanxuan": 0, "youpin": 0}
+  for _, r := range rules {
+    if v, ok := currencies[r.Name]; ok && r.Currency != v {
+      t.Errorf("%s: expect currency %d, got %d", r.Name, v, r.Currency)
+    }
+  }
+}
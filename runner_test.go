@@ -2,18 +2,25 @@ package main
 
 import (
   "fmt"
+  "os/exec"
+  "runtime"
   "testing"
 )
 
-func doInit() {
+// 需要真实Chrome的测试，没有安装Chrome时跳过
+func requireChrome(t *testing.T) {
   LoadConf("conf.yaml")
-  LoadRules(Conf.Task.Rules)
-  initLogger()
-  initStore()
-  initChrome()
+  c := Conf.Chrome.Linux
+  if runtime.GOOS == "windows" {
+    c = Conf.Chrome.Windows
+  }
+  if _, e := exec.LookPath(c.Exec); e != nil {
+    t.Skip("chrome not found")
+  }
 }
 
 func TestURL(t *testing.T) {
+  requireChrome(t)
   doInit()
   urls := []string{
     `https://item.jd.com/11929332775.html`,
@@ -23,12 +30,13 @@ func TestURL(t *testing.T) {
     `http://market.m.taobao.com/app/dinamic/h5-tb-detail/index.html?id=563557797907&scm=1007.12144.95804.100200300000000&pg1stepk=sdm:50630_item_563557797907&spm=a2114u.9628.2.1`,
   }
   for _, v := range urls {
-    addr, _, _ := normalizeURL(v)
+    addr, _, _ := normalizeURL(currentRules(), v)
     t.Log(addr)
   }
 }
 
 func TestCrawl(t *testing.T) {
+  requireChrome(t)
   doInit()
   urls := []string{
     `https://www.amazon.cn/dp/B06XKCV7X9/ref=cngwdyfloorv2_recs_0?pf_rd_p=3aeea79d-b33f-46f8-8020-d2edee624402&pf_rd_s=desktop-2&pf_rd_t=36701&pf_rd_i=desktop&pf_rd_m=A1AJ19PSB66TGU&pf_rd_r=G98F6MD6MF7T8873BEP8&pf_rd_r=G98F6MD6MF7T8873BEP8&pf_rd_p=3aeea79d-b33f-46f8-8020-d2edee624402`,
@@ -42,16 +50,13 @@ func TestCrawl(t *testing.T) {
     `https://detail.vip.com/detail-2939221-566720643.html`,
   }
   for i, v := range urls {
-    addr, rule, chain := normalizeURL(v)
-    p := doCrawl(addr, rule, chain)
-    if p == nil {
-      t.Logf("nil(%d)\n", i)
-      continue
-    }
-    if p.ID == "" || p.Price == NoValue {
-      t.Logf("empty(%d)\n", i)
+    addr, rule, chain := normalizeURL(currentRules(), v)
+    r := doCrawl(addr, rule, chain)
+    if !r.ok() {
+      t.Logf("failed(%d), %s\n", i, r)
       continue
     }
+    p := r.Product
     if p.Price == RangePrice {
       t.Log(fmt.Sprintf("ID=[%s], price=[%.2f,%.2f], comments=[%d,%d,%d,%d,%d,%d]\n", p.ID, p.PriceLow, p.PriceHigh, p.Comments.Total, p.Comments.Star5, p.Comments.Star3, p.Comments.Star1, p.Comments.Image, p.Comments.Append))
     } else {
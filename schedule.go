@@ -0,0 +1,177 @@
+package main
+
+import (
+  "net/url"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/times"
+)
+
+// 所有任务共用的调度器，
+// 站点的请求时间跨任务保留，连续的两个任务也不会对同一站点连续请求
+var sched = &scheduler{next: make(map[string]time.Time, 16)}
+
+type scheduler struct {
+  mu sync.Mutex
+
+  // 站点下一次可以开始请求的时间，key是规则名（没有规则的是域名）
+  next map[string]time.Time
+}
+
+// 一个要调度的抓取，n是payload的下标
+type crawlJob struct {
+  n    int
+  site string
+  conf PolitenessConf
+}
+
+type site struct {
+  name     string
+  conf     PolitenessConf
+  queue    []int
+  inflight int
+}
+
+// 根据链接找到站点和对应的限制，
+// 有规则的以规则名为站点，规则中没有配置的限制使用task.politeness，
+// 没有规则的（如短链接）以域名为站点，使用task.politeness，
+// 这种链接打开页面转换为标准URL后，还要按转换后的站点等待（见scheduler.follow）
+func politenessOf(rs ruleSet, addr string) (string, PolitenessConf) {
+  c := Conf.Task.Politeness
+  r := rs.findRuleByURL(addr)
+  if r == nil {
+    u, e := url.Parse(addr)
+    if e != nil || u.Hostname() == "" {
+      return addr, c
+    }
+    return u.Hostname(), c
+  }
+  if r.Politeness != nil {
+    if r.Politeness.Interval > 0 {
+      c.Interval = r.Politeness.Interval
+    }
+    if r.Politeness.Jitter > 0 {
+      c.Jitter = r.Politeness.Jitter
+    }
+    if r.Politeness.Concurrency > 0 {
+      c.Concurrency = r.Politeness.Concurrency
+    }
+  }
+  return r.Name, c
+}
+
+// 调度执行所有f(job.n)，所有f都返回后run才返回，
+// 总并发数不超过标签页池的大小，每个站点的并发数、请求间隔都不超过各自的限制，
+// 多个站点之间轮流执行，不会因为一个站点在等待而阻塞其他站点，
+// Runner关闭时不再启动新的f，只等待已经启动的返回
+func (s *scheduler) run(jobs []*crawlJob, f func(n int)) {
+  sites := make([]*site, 0, 4)
+  m := make(map[string]*site, 4)
+  for _, j := range jobs {
+    st, ok := m[j.site]
+    if !ok {
+      st = &site{name: j.site, conf: j.conf, queue: make([]int, 0, len(jobs))}
+      m[j.site] = st
+      sites = append(sites, st)
+    }
+    st.queue = append(st.queue, j.n)
+  }
+  done := make(chan *site, len(jobs))
+  // cursor是下一次优先尝试的站点，每启动一个抓取就移到下一个站点，这样各个站点会交替执行
+  running, remaining, cursor := 0, len(jobs), 0
+  stop := stopChan
+  for remaining > 0 {
+    if stop != nil && stopping() {
+      stop = nil
+      for _, st := range sites {
+        remaining -= len(st.queue)
+        st.queue = nil
+      }
+      continue
+    }
+    var wait time.Duration
+    if running < tabs.size() {
+      now := times.Now()
+      for k := range sites {
+        st := sites[(cursor+k)%len(sites)]
+        if len(st.queue) == 0 || (st.conf.Concurrency > 0 && st.inflight >= st.conf.Concurrency) {
+          continue
+        }
+        if d := s.reserve(st, now); d > 0 {
+          if wait == 0 || d < wait {
+            wait = d
+          }
+          continue
+        }
+        n := st.queue[0]
+        st.queue = st.queue[1:]
+        st.inflight++
+        running++
+        cursor = (cursor + k + 1) % len(sites)
+        wait = -1
+        go func(st *site, n int) {
+          f(n)
+          done <- st
+        }(st, n)
+        break
+      }
+    }
+    // 刚启动了一个抓取，继续尝试启动下一个
+    if wait < 0 {
+      continue
+    }
+    var timer <-chan time.Time
+    if wait > 0 {
+      timer = time.After(wait)
+    }
+    select {
+    case st := <-done:
+      st.inflight--
+      running--
+      remaining--
+    case <-timer:
+    case <-stop:
+    }
+  }
+}
+
+// 站点现在可以请求就占用这次请求（计算下一次可以请求的时间）并返回0，
+// 否则返回还需要等待的时间
+func (s *scheduler) reserve(st *site, now time.Time) time.Duration {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if next, ok := s.next[st.name]; ok && next.After(now) {
+    return next.Sub(now)
+  }
+  s.next[st.name] = now.Add(gap(st.conf))
+  return 0
+}
+
+// 打开页面后才知道站点的链接（如短链接，调度时的站点是短链接的域名），
+// 打开页面算作对该站点的一次请求，再等到下一次可以请求的时间并占用这次请求（接下来的抓取），
+// Runner关闭时不再等待
+func (s *scheduler) follow(name string, c PolitenessConf) {
+  now := times.Now()
+  s.mu.Lock()
+  if next := now.Add(gap(c)); next.After(s.next[name]) {
+    s.next[name] = next
+  }
+  s.mu.Unlock()
+  st := &site{name: name, conf: c}
+  for {
+    d := s.reserve(st, times.Now())
+    if d == 0 || !sleep(d) {
+      return
+    }
+  }
+}
+
+// 两次请求之间的间隔
+func gap(c PolitenessConf) time.Duration {
+  d := time.Millisecond * time.Duration(c.Interval)
+  if c.Jitter > 0 {
+    d += times.RandMillis(0, c.Jitter)
+  }
+  return d
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+  "sync"
+  "testing"
+  "time"
+)
+
+func TestSchedulerRun(t *testing.T) {
+  oldTabs := tabs
+  tabs = newTabPool("", 4)
+  defer func() {
+    tabs = oldTabs
+  }()
+  s := &scheduler{next: make(map[string]time.Time)}
+  slow := PolitenessConf{Interval: 100, Concurrency: 1}
+  fast := PolitenessConf{}
+  jobs := []*crawlJob{
+    {n: 0, site: "a", conf: slow},
+    {n: 1, site: "a", conf: slow},
+    {n: 2, site: "a", conf: slow},
+    {n: 3, site: "b", conf: fast},
+    {n: 4, site: "b", conf: fast},
+  }
+  var mu sync.Mutex
+  starts := make(map[int]time.Time, len(jobs))
+  s.run(jobs, func(n int) {
+    mu.Lock()
+    starts[n] = time.Now()
+    mu.Unlock()
+    time.Sleep(time.Millisecond * 10)
+  })
+  if len(starts) != len(jobs) {
+    t.Fatalf("expect %d jobs, got %d", len(jobs), len(starts))
+  }
+  // 站点a的请求间隔不小于interval
+  for n := 1; n <= 2; n++ {
+    if d := starts[n].Sub(starts[n-1]); d < time.Millisecond*100 {
+      t.Errorf("site a: job %d started %v after job %d", n, d, n-1)
+    }
+  }
+  // 站点b不会排在站点a的后面等待
+  for n := 3; n <= 4; n++ {
+    if !starts[n].Before(starts[1]) {
+      t.Errorf("site b: job %d queued behind site a", n)
+    }
+  }
+}
+
+func TestSchedulerFollow(t *testing.T) {
+  s := &scheduler{next: make(map[string]time.Time)}
+  c := PolitenessConf{Interval: 100}
+  // 打开页面算一次请求，之后的抓取要等interval
+  start := time.Now()
+  s.follow("a", c)
+  if d := time.Since(start); d < time.Millisecond*100 {
+    t.Errorf("expect to wait interval, waited %v", d)
+  }
+  // 抓取也占用了一次请求
+  if d := s.next["a"].Sub(start); d < time.Millisecond*200 {
+    t.Errorf("expect next request after 200ms, got %v", d)
+  }
+}
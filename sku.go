@@ -0,0 +1,150 @@
+package main
+
+import (
+  "encoding/json"
+  "regexp"
+  "strings"
+  "time"
+
+  "github.com/kwf2030/commons/cdp"
+)
+
+// 按SKU（颜色、尺码等规格的组合）抓取，
+// 商品的脚本执行完后，枚举所有的SKU，依次选中每个SKU，再执行规则中的price和stock脚本
+type skuConf struct {
+  // 原始链接中SKU ID的正则（第一个分组），能匹配到时只抓这个SKU，如天猫链接中的skuId=(\d+)
+  Match      []string         `yaml:"match"`
+  MatchRegex []*regexp.Regexp `yaml:"-"`
+
+  // 枚举SKU的脚本，返回JSON数组，每个元素为{"id":"SKU ID","name":"规格名称"}
+  List string `yaml:"list"`
+
+  // 选中一个SKU的脚本，$sku会被替换为SKU ID，不能选中（如已售完）时返回"false"
+  Select string `yaml:"select"`
+
+  // 选中后等待页面更新的时间（毫秒）
+  Sleep int `yaml:"sleep"`
+
+  // 最多抓多少个SKU，0表示不限制
+  Max int `yaml:"max"`
+}
+
+// 链接中指定的SKU，没有时返回空字符串
+func (r *rule) pinnedSKU(addr string) string {
+  if r == nil || r.SKU == nil {
+    return ""
+  }
+  for _, re := range r.SKU.MatchRegex {
+    if arr := re.FindStringSubmatch(addr); len(arr) > 1 && arr[1] != "" {
+      return arr[1]
+    }
+  }
+  return ""
+}
+
+// 转换为标准URL，并记录原始链接中指定的SKU（标准URL中可能没有SKU），
+// 转换时打开了页面的，按转换后的站点等待抓取限制
+func newURLResult(rs ruleSet, raw string) (*crawlResult, *rule) {
+  tr := &normalizeTrace{}
+  addr, rule, _ := normalize(rs, raw, tr)
+  if tr.Evaluated && rule != nil {
+    sched.follow(politenessOf(rs, addr))
+  }
+  r := newCrawlResult(addr)
+  r.SKU = rule.pinnedSKU(raw)
+  if r.SKU == "" {
+    r.SKU = rule.pinnedSKU(addr)
+  }
+  return r, rule
+}
+
+// 枚举并抓取每个SKU，结果保存在Product.SKUs中，链接中指定了SKU时只抓这个SKU，它的价格和库存作为商品的价格和库存，
+// 指定的SKU不能选中或没抓到价格时抓取失败（不能用商品的价格代替，商品的价格可能是所有SKU的价格区间），
+// 返回false表示标签页已经不可用
+func crawlSKUs(tab *cdp.Tab, id string, rule *rule, r *crawlResult) bool {
+  c := rule.SKU
+  p := r.Product
+  start := time.Now()
+  raw, ok := evaluate(tab, strings.Replace(c.List, "$id", id, -1))
+  if !ok {
+    r.fail(failTab, "sku.list")
+    return false
+  }
+  r.trace(&script{Name: "sku.list"}, raw, "", start)
+  var arr []*SKU
+  json.Unmarshal([]byte(raw), &arr)
+  skus := make([]*SKU, 0, len(arr))
+  for _, v := range arr {
+    if v != nil && v.ID != "" && (r.SKU == "" || v.ID == r.SKU) {
+      skus = append(skus, v)
+    }
+  }
+  // 枚举不到时也尝试选中指定的SKU
+  if r.SKU != "" && len(skus) == 0 {
+    skus = append(skus, &SKU{ID: r.SKU})
+  }
+  if c.Max > 0 && len(skus) > c.Max {
+    skus = skus[:c.Max]
+  }
+  for _, v := range skus {
+    if !crawlSKU(tab, id, rule, r, v) {
+      return false
+    }
+  }
+  if len(skus) > 0 {
+    p.SKUs = skus
+  }
+  if r.SKU != "" {
+    p.SKU = r.SKU
+    v := skus[0]
+    p.Price, p.PriceLow, p.PriceHigh, p.Stock = v.Price, v.PriceLow, v.PriceHigh, v.Stock
+    if v.Price == NoValue || v.Price == NoScript || (v.Price == RangePrice && v.PriceLow == 0 && v.PriceHigh == 0) {
+      r.fail(failSKU, "price")
+    }
+  }
+  return true
+}
+
+// 选中一个SKU，执行price和stock脚本
+func crawlSKU(tab *cdp.Tab, id string, rule *rule, r *crawlResult, sku *SKU) bool {
+  start := time.Now()
+  expression := strings.Replace(strings.Replace(rule.SKU.Select, "$id", id, -1), "$sku", sku.ID, -1)
+  raw, ok := evaluate(tab, expression)
+  if !ok {
+    r.fail(failTab, "sku.select")
+    return false
+  }
+  r.trace(&script{Name: "sku.select"}, raw, sku.ID, start)
+  if raw == "false" {
+    sku.Price, sku.Stock = NoValue, NoValue
+    return true
+  }
+  if rule.SKU.Sleep > 0 {
+    time.Sleep(time.Millisecond * time.Duration(rule.SKU.Sleep))
+  }
+  tmp := NewProduct()
+  for _, v := range rule.Scripts {
+    if v.Async || (v.Name != "price" && v.Name != "stock") {
+      continue
+    }
+    expression := v.Script
+    if v.Plan != nil {
+      expression = v.Plan.expression
+    }
+    expression = strings.Replace(expression, "$id", id, -1)
+    start := time.Now()
+    raw, ok := evaluate(tab, expression)
+    if !ok {
+      r.fail(failTab, "sku."+v.Name)
+      return false
+    }
+    s := raw
+    if v.Plan != nil {
+      s = v.Plan.apply(s)
+    }
+    handle(rule.Locale, v.Name, s, tmp)
+    r.trace(&script{Name: "sku." + v.Name}, raw, s, start)
+  }
+  sku.Price, sku.PriceLow, sku.PriceHigh, sku.Stock = tmp.Price, tmp.PriceLow, tmp.PriceHigh, tmp.Stock
+  return true
+}
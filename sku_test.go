@@ -0,0 +1,90 @@
+package main
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestCrawlSKUs(t *testing.T) {
+  fc, teardown := setupFakeChrome(t, 1)
+  defer teardown()
+  dir, e := ioutil.TempDir("", "rules")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  rule := testRule + `
+sku:
+  match:
+    - "skuId=(\\w+)"
+  list: "LIST($id)"
+  select: "SELECT($sku)"
+`
+  ioutil.WriteFile(filepath.Join(dir, "shop.yaml"), []byte(rule), 0644)
+  rules, problems := loadRules(dir)
+  if len(rules) != 1 {
+    t.Fatal(problems)
+  }
+  rs := ruleSet(rules)
+
+  // a和b的价格分别为10和20，c已售完
+  prices := map[string]string{"a": "10", "b": "20"}
+  selected := ""
+  fc.Evaluate = func(addr, expression string) (string, bool) {
+    switch {
+    case strings.HasPrefix(expression, "LIST"):
+      return `[{"id":"a","name":"red"},{"id":"b","name":"blue"},{"id":"c","name":"green"}]`, true
+    case strings.HasPrefix(expression, "SELECT"):
+      selected = strings.TrimSuffix(strings.TrimPrefix(expression, "SELECT("), ")")
+      if prices[selected] == "" {
+        return "false", true
+      }
+      return "true", true
+    case strings.HasPrefix(expression, "PRICE") && selected != "":
+      return prices[selected], true
+    }
+    return shopEvaluate(addr, expression)
+  }
+
+  r := crawlWith(newURLResult(rs, "https://www.shop.test/item?id=1"))
+  p := r.Product
+  if !r.ok() || p.Price != 1 || p.SKU != "" || len(p.SKUs) != 3 {
+    t.Fatalf("unexpected product %+v", p)
+  }
+  if v := p.SKUs[0]; v.ID != "a" || v.Name != "red" || v.Price != 10 {
+    t.Errorf("unexpected sku %+v", v)
+  }
+  if v := p.SKUs[1]; v.ID != "b" || v.Price != 20 {
+    t.Errorf("unexpected sku %+v", v)
+  }
+  if v := p.SKUs[2]; v.ID != "c" || v.Price != NoValue || v.Stock != NoValue {
+    t.Errorf("unexpected sku %+v", v)
+  }
+
+  // 链接中指定了SKU时只抓这个SKU，转换到标准URL后也保留
+  selected = ""
+  r = crawlWith(newURLResult(rs, "https://m.shop.test/detail?id=1&skuId=b"))
+  p = r.Product
+  if !r.ok() || r.URL != "https://www.shop.test/item?id=1" || p.SKU != "b" || p.Price != 20 || len(p.SKUs) != 1 || p.key() != "1#b" {
+    t.Errorf("unexpected product %+v", p)
+  }
+
+  // 指定的SKU不能选中时抓取失败，不能用商品的价格代替
+  selected = ""
+  r = crawlWith(newURLResult(rs, "https://www.shop.test/item?id=1&skuId=c"))
+  p = r.Product
+  if r.Kind != failSKU || r.Field != "price" || p.SKU != "c" || p.Price != NoValue || p.Stock != NoValue {
+    t.Errorf("expect sku failure, got %s, product %+v", r, p)
+  }
+
+  // 指定的SKU没抓到价格时也失败
+  prices["d"] = "-"
+  selected = ""
+  r = crawlWith(newURLResult(rs, "https://www.shop.test/item?id=1&skuId=d"))
+  if r.Kind != failSKU || r.Product.Price == 1 {
+    t.Errorf("expect sku failure, got %s, product %+v", r, r.Product)
+  }
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+  "bytes"
+  "encoding/binary"
+  "encoding/json"
+  "fmt"
+  "time"
+
+  "github.com/kwf2030/commons/boltdb"
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+// 商品的价格历史，key是商品ID+0+抓取时间（8字节纳秒，大端），value是historyPoint，
+// 同一个商品的记录是按时间排序的，最多保留store.history天
+var bucketHistory = []byte("history")
+
+type historyPoint struct {
+  Price     float64   `json:"price"`
+  PriceLow  float64   `json:"price_low,omitempty"`
+  PriceHigh float64   `json:"price_high,omitempty"`
+  Stock     int       `json:"stock"`
+  Sales     int       `json:"sales"`
+  Time      time.Time `json:"time"`
+}
+
+func historyPrefix(id string) []byte {
+  return append([]byte(id), 0)
+}
+
+func historyKey(id string, t time.Time) []byte {
+  k := historyPrefix(id)
+  ts := make([]byte, 8)
+  binary.BigEndian.PutUint64(ts, uint64(t.UnixNano()))
+  return append(k, ts...)
+}
+
+// 商品在store中的key，链接中指定了SKU的商品按SKU分开保存（id#sku）
+func productKey(id, sku string) string {
+  if sku == "" {
+    return id
+  }
+  return id + "#" + sku
+}
+
+func (p *Product) key() string {
+  return productKey(p.ID, p.SKU)
+}
+
+// 保存抓到的商品（最新的一次）和价格历史，并删除超过保留时间的历史
+func saveProduct(p *Product) {
+  key := p.key()
+  data, _ := json.Marshal(p)
+  e := store.UpdateV(bucketProducts, []byte(key), data)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Store")
+  }
+  if Conf.Store.History <= 0 {
+    return
+  }
+  data, _ = json.Marshal(&historyPoint{
+    Price:     p.Price,
+    PriceLow:  p.PriceLow,
+    PriceHigh: p.PriceHigh,
+    Stock:     p.Stock,
+    Sales:     p.Sales,
+    Time:      p.UpdateTime,
+  })
+  expire := historyKey(key, p.UpdateTime.AddDate(0, 0, -Conf.Store.History))
+  prefix := historyPrefix(key)
+  e = store.UpdateB(bucketHistory, func(b *bbolt.Bucket) error {
+    // 遍历时删除会跳过下一个key，所以先找出所有过期的
+    expired := make([][]byte, 0, 4)
+    c := b.Cursor()
+    for k, _ := c.Seek(prefix); k != nil && bytes.Compare(k, expire) < 0; k, _ = c.Next() {
+      expired = append(expired, k)
+    }
+    for _, k := range expired {
+      if e := b.Delete(k); e != nil {
+        return e
+      }
+    }
+    return b.Put(historyKey(key, p.UpdateTime), data)
+  })
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Store History")
+  }
+}
+
+// 商品since之后的价格历史（按时间排序），since为零值时返回所有的历史
+func productHistory(id string, since time.Time) []*historyPoint {
+  ret := make([]*historyPoint, 0, 8)
+  prefix := historyPrefix(id)
+  from := prefix
+  if !since.IsZero() {
+    from = historyKey(id, since)
+  }
+  store.QueryB(bucketHistory, func(b *bbolt.Bucket) error {
+    c := b.Cursor()
+    for k, v := c.Seek(from); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+      point := &historyPoint{}
+      if json.Unmarshal(v, point) == nil {
+        ret = append(ret, point)
+      }
+    }
+    return nil
+  })
+  return ret
+}
+
+// 与上次抓到的商品比较，得到上次的价格、价格是否变化和最近store.lowest天的最低价，
+// 第一次抓到的商品没有上次的价格，Changed为false
+func comparePrice(payload *Payload) {
+  p := payload.Product
+  data := store.Get(bucketProducts, []byte(p.key()))
+  if data != nil {
+    last := &Product{}
+    if json.Unmarshal(data, last) == nil {
+      payload.PreviousPrice = &last.Price
+      payload.PreviousPriceLow = last.PriceLow
+      payload.PreviousPriceHigh = last.PriceHigh
+      payload.Changed = priceChanged(last, p)
+    }
+  }
+  if Conf.Store.Lowest > 0 {
+    lowest := lowPrice(p.Price, p.PriceLow)
+    for _, v := range productHistory(p.key(), times.Now().AddDate(0, 0, -Conf.Store.Lowest)) {
+      if price := lowPrice(v.Price, v.PriceLow); price >= 0 && (lowest < 0 || price < lowest) {
+        lowest = price
+      }
+    }
+    if lowest >= 0 {
+      payload.LowestPrice = lowest
+    }
+  }
+}
+
+// 价格（区间价格是最低的价格），没有价格时返回负数
+func lowPrice(price, priceLow float64) float64 {
+  if price == RangePrice {
+    if priceLow > 0 {
+      return priceLow
+    }
+    return NoValue
+  }
+  return price
+}
+
+// 价格是否变化，任意一方没有价格（NoScript/NoValue）都算没有变化
+func priceChanged(last, p *Product) bool {
+  if last.Price == RangePrice && p.Price == RangePrice {
+    if last.PriceLow < 0 || last.PriceHigh < 0 || p.PriceLow < 0 || p.PriceHigh < 0 {
+      return false
+    }
+    return last.PriceLow != p.PriceLow || last.PriceHigh != p.PriceHigh
+  }
+  if last.Price >= 0 && p.Price >= 0 {
+    return last.Price != p.Price
+  }
+  return false
+}
+
+// 删除before之前没有抓过的商品和它们的价格历史，返回删除的数量
+func evictProducts(before time.Time) (int, error) {
+  ids := make([][]byte, 0, 16)
+  e := store.EachKV(bucketProducts, func(k, v []byte, n int) error {
+    p := &Product{}
+    if json.Unmarshal(v, p) != nil || p.UpdateTime.Before(before) {
+      ids = append(ids, append([]byte(nil), k...))
+    }
+    return nil
+  })
+  if e != nil || len(ids) == 0 {
+    return 0, e
+  }
+  e = store.Update(func(tx *bbolt.Tx) error {
+    products, history := tx.Bucket(bucketProducts), tx.Bucket(bucketHistory)
+    for _, id := range ids {
+      if e := products.Delete(id); e != nil {
+        return e
+      }
+      if history == nil {
+        continue
+      }
+      prefix := historyPrefix(string(id))
+      keys := make([][]byte, 0, 8)
+      c := history.Cursor()
+      for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+        keys = append(keys, k)
+      }
+      for _, k := range keys {
+        if e := history.Delete(k); e != nil {
+          return e
+        }
+      }
+    }
+    return nil
+  })
+  if e != nil {
+    return 0, e
+  }
+  return len(ids), nil
+}
+
+// 每隔store.evict_interval分钟删除超过store.ttl天没有抓过的商品，Runner关闭时退出
+func evictLoop() {
+  if Conf.Store.TTL <= 0 || Conf.Store.EvictInterval <= 0 {
+    return
+  }
+  for sleep(time.Minute * time.Duration(Conf.Store.EvictInterval)) {
+    n, e := evictProducts(times.Now().AddDate(0, 0, -Conf.Store.TTL))
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Evict")
+      continue
+    }
+    logger.Info().Msgf("evict products, ok, count=%d", n)
+    n, e = evictDiscovered(times.Now().AddDate(0, 0, -Conf.Store.TTL))
+    if e != nil {
+      logger.Error().Err(e).Msg("ERR: Evict Discovered")
+      continue
+    }
+    logger.Info().Msgf("evict discovered, ok, count=%d", n)
+  }
+}
+
+// 打开store，已经被其他进程（如正在运行的Runner）打开时，等待timeout后返回错误
+func openStore(path string, timeout time.Duration) (*boltdb.Store, error) {
+  db, e := bbolt.Open(path, 0644, &bbolt.Options{Timeout: timeout})
+  if e == bbolt.ErrTimeout {
+    return nil, fmt.Errorf("%s is locked, stop the runner first", path)
+  }
+  if e != nil {
+    return nil, e
+  }
+  e = db.Update(func(tx *bbolt.Tx) error {
+    for _, b := range [][]byte{bucketProducts, bucketHistory, bucketDiscovered} {
+      if _, e := tx.CreateBucketIfNotExists(b); e != nil {
+        return e
+      }
+    }
+    return nil
+  })
+  if e != nil {
+    db.Close()
+    return nil, e
+  }
+  return &boltdb.Store{DB: db}, nil
+}
+
+// 把src中所有的bucket复制到dst（新文件），删除数据后空出的页不会被复制，
+// 每个事务最多复制batch个key
+func compactStore(dst, src *bbolt.DB, batch int) error {
+  return src.View(func(stx *bbolt.Tx) error {
+    return stx.ForEach(func(name []byte, sb *bbolt.Bucket) error {
+      e := dst.Update(func(tx *bbolt.Tx) error {
+        _, e := tx.CreateBucketIfNotExists(name)
+        return e
+      })
+      if e != nil {
+        return e
+      }
+      c := sb.Cursor()
+      k, v := c.First()
+      for k != nil {
+        e = dst.Update(func(tx *bbolt.Tx) error {
+          b := tx.Bucket(name)
+          // 按key的顺序写入，填满每一页
+          b.FillPercent = 1
+          for i := 0; k != nil && i < batch; i++ {
+            if e := b.Put(k, v); e != nil {
+              return e
+            }
+            k, v = c.Next()
+          }
+          return nil
+        })
+        if e != nil {
+          return e
+        }
+      }
+      return nil
+    })
+  })
+}
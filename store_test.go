@@ -0,0 +1,159 @@
+package main
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/commons/boltdb"
+  "github.com/kwf2030/commons/times"
+  "go.etcd.io/bbolt"
+)
+
+func TestProductHistory(t *testing.T) {
+  defer setupStore(t)()
+  old := Conf.Store
+  Conf.Store = StoreConf{History: 10, Lowest: 3}
+  defer func() {
+    Conf.Store = old
+  }()
+  now := times.Now()
+  // 20天前的在保存5天前的时候被删除（超过10天），1天前的是区间价格
+  for i, v := range []struct {
+    days  int
+    price float64
+  }{{20, 1}, {5, 50}, {2, 80}, {1, 100}} {
+    p := NewProduct()
+    p.ID, p.Price, p.UpdateTime = "1", v.price, now.AddDate(0, 0, -v.days)
+    if i == 3 {
+      p.Price, p.PriceLow, p.PriceHigh = RangePrice, v.price, v.price+10
+    }
+    saveProduct(p)
+  }
+  saveProduct(&Product{ID: "10", Price: 1, UpdateTime: now})
+  arr := productHistory("1", now.AddDate(0, 0, -30))
+  if len(arr) != 3 || arr[0].Price != 50 || arr[2].Price != RangePrice || arr[2].PriceLow != 100 {
+    t.Fatalf("unexpected history %v", arr)
+  }
+
+  // 上次是区间价格，这次不是，算没有变化，最低价只统计最近3天
+  payload := &Payload{Product: &Product{ID: "1", Price: 90, UpdateTime: now}}
+  comparePrice(payload)
+  if payload.PreviousPrice == nil || *payload.PreviousPrice != RangePrice || payload.PreviousPriceLow != 100 || payload.Changed || payload.LowestPrice != 80 {
+    t.Errorf("unexpected payload %+v", payload)
+  }
+  // 第一次抓到
+  payload = &Payload{Product: &Product{ID: "2", Price: 90, UpdateTime: now}}
+  comparePrice(payload)
+  if payload.PreviousPrice != nil || payload.Changed || payload.LowestPrice != 90 {
+    t.Errorf("unexpected payload %+v", payload)
+  }
+  if data, _ := json.Marshal(payload); strings.Contains(string(data), "previous_price") {
+    t.Errorf("unexpected previous price %s", data)
+  }
+  // 上次的价格是0也要提交
+  saveProduct(&Product{ID: "3", Price: 0, UpdateTime: now})
+  payload = &Payload{Product: &Product{ID: "3", Price: 10, UpdateTime: now}}
+  comparePrice(payload)
+  if data, _ := json.Marshal(payload); !strings.Contains(string(data), `"previous_price":0`) {
+    t.Errorf("expect previous price 0, got %s", data)
+  }
+}
+
+func TestPriceChanged(t *testing.T) {
+  for _, v := range []struct {
+    last, p *Product
+    changed bool
+  }{
+    {&Product{Price: 1}, &Product{Price: 2}, true},
+    {&Product{Price: 1}, &Product{Price: 1}, false},
+    {&Product{Price: 0}, &Product{Price: 1}, true},
+    {&Product{Price: NoValue}, &Product{Price: 1}, false},
+    {&Product{Price: 1}, &Product{Price: NoScript}, false},
+    {&Product{Price: RangePrice, PriceLow: 1, PriceHigh: 2}, &Product{Price: RangePrice, PriceLow: 1, PriceHigh: 3}, true},
+    {&Product{Price: RangePrice, PriceLow: 1, PriceHigh: 2}, &Product{Price: RangePrice, PriceLow: 1, PriceHigh: 2}, false},
+    {&Product{Price: RangePrice, PriceLow: 1, PriceHigh: 2}, &Product{Price: 1}, false},
+  } {
+    if changed := priceChanged(v.last, v.p); changed != v.changed {
+      t.Errorf("expect %v, got %v, %+v -> %+v", v.changed, changed, v.last, v.p)
+    }
+  }
+}
+
+func TestEvictProducts(t *testing.T) {
+  defer setupStore(t)()
+  old := Conf.Store
+  Conf.Store = StoreConf{History: 10}
+  defer func() {
+    Conf.Store = old
+  }()
+  now := times.Now()
+  saveProduct(&Product{ID: "1", Price: 1, UpdateTime: now.AddDate(0, 0, -5)})
+  saveProduct(&Product{ID: "10", Price: 10, UpdateTime: now})
+  n, e := evictProducts(now.AddDate(0, 0, -1))
+  if e != nil || n != 1 {
+    t.Fatalf("expect 1 evicted, got %d, %v", n, e)
+  }
+  if store.Get(bucketProducts, []byte("1")) != nil || len(productHistory("1", time.Time{})) != 0 {
+    t.Error("expect product 1 to be evicted")
+  }
+  if store.Get(bucketProducts, []byte("10")) == nil || len(productHistory("10", time.Time{})) != 1 {
+    t.Error("expect product 10 to be kept")
+  }
+}
+
+func TestImportAndCompact(t *testing.T) {
+  defer setupStore(t)()
+  now := times.Now()
+  saveProduct(&Product{ID: "1", Price: 1, UpdateTime: now})
+  ut := now.Format(time.RFC3339)
+  dump := `{"id":"1","price":2,"update_time":"2018-01-01T00:00:00+08:00"}
+{"id":"2","price":2,"update_time":"` + ut + `"}
+
+{"id":"3","price":3,"update_time":"` + ut + `"}
+`
+  imported, skipped, e := importProducts(strings.NewReader(dump))
+  if e != nil || imported != 2 || skipped != 1 {
+    t.Fatalf("expect 2 imported 1 skipped, got %d/%d, %v", imported, skipped, e)
+  }
+  if _, _, e = importProducts(strings.NewReader("{\"id\":\"4\"}\nnot json\n")); e == nil || !strings.Contains(e.Error(), "line 2") {
+    t.Errorf("expect error at line 2, got %v", e)
+  }
+
+  // 删除后压缩，数据不变
+  for i := 100; i < 2100; i++ {
+    saveProduct(&Product{ID: strconv.Itoa(i), Title: strings.Repeat("x", 100), UpdateTime: now.AddDate(0, 0, -1)})
+  }
+  evictProducts(now.AddDate(0, 0, -1).Add(time.Second))
+  dir, _ := ioutil.TempDir("", "compact")
+  defer os.RemoveAll(dir)
+  dst, e := bbolt.Open(filepath.Join(dir, "runner.db"), 0644, nil)
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer dst.Close()
+  if e = compactStore(dst, store.DB, 100); e != nil {
+    t.Fatal(e)
+  }
+  src := store
+  store = &boltdb.Store{DB: dst}
+  defer func() {
+    store = src
+  }()
+  if n, _ := store.CountKV(bucketProducts); n != 3 {
+    t.Errorf("expect 3 products, got %d", n)
+  }
+  if p := store.Get(bucketProducts, []byte("1")); !strings.Contains(string(p), `"price":1`) {
+    t.Errorf("unexpected product %s", p)
+  }
+  before, _ := os.Stat(src.DB.Path())
+  after, _ := os.Stat(dst.Path())
+  if after.Size() >= before.Size() {
+    t.Errorf("expect compacted store to be smaller, %d -> %d", before.Size(), after.Size())
+  }
+}
@@ -76,11 +76,55 @@ type Task struct {
   // 消息抓完成后先提交（一个Task最多可以分成两次提交），
   // 如果Payloads[i].Message有值，Payloads[i]中的Message和Product一定是对应的
   Payloads []*Payload `json:"payloads,omitempty"`
+
+  // 任务中每个消息/商品的结果（包括没抓到和跳过的），与Payloads是分开的，
+  // 只读取Payloads的旧版本Dispatcher不受影响，
+  // Runner关闭时放回队列的消息/商品没有结果（由新的任务报告）
+  Results []*Result `json:"results,omitempty"`
 }
 
 type Payload struct {
   Message *Message `json:"message,omitempty"`
   Product *Product `json:"product,omitempty"`
+
+  // 上次抓到的价格（与Product.Price的取值相同），第一次抓到的商品没有（nil），
+  // 用指针是为了区分没有上次的价格和上次的价格是0
+  PreviousPrice     *float64 `json:"previous_price,omitempty"`
+  PreviousPriceLow  float64  `json:"previous_price_low,omitempty"`
+  PreviousPriceHigh float64  `json:"previous_price_high,omitempty"`
+
+  // 价格与上次相比是否有变化（任意一次没抓到价格都算没有变化）
+  Changed bool `json:"changed,omitempty"`
+
+  // 最近store.lowest天（包括这一次）的最低价，区间价格按最低的价格算
+  LowestPrice float64 `json:"lowest_price,omitempty"`
+}
+
+type Result struct {
+  // 消息ID（消息任务）或商品ID（商品任务），
+  // 抓到时ProductID是抓到的商品ID，否则是任务中的商品ID
+  MessageID string `json:"message_id,omitempty"`
+  ProductID string `json:"product_id,omitempty"`
+
+  // 任务中的链接（商品任务）
+  URL string `json:"url,omitempty"`
+
+  // ok：抓到了（在Payloads中），
+  // skipped：在crawl_duration内已经抓过，没有再抓，
+  // no_url：提取不到链接，
+  // unsupported：不支持的网站，
+  // no_id：链接中匹配不到商品ID，
+  // tab：标签页不可用（跳转失败、连接断开或无响应），
+  // timeout：页面加载超时并且没抓到价格，
+  // extract：没抓到价格，
+  // id_mismatch：抓到的商品ID与任务中的不一致
+  Status string `json:"status"`
+
+  // 失败的阶段或脚本名，如navigate、price
+  Field string `json:"field,omitempty"`
+
+  // 抓取的次数（包括重试）
+  Attempts int `json:"attempts,omitempty"`
 }
 
 type Message struct {
@@ -134,6 +178,18 @@ type Product struct {
   // 评论统计，不是所有平台都有评论
   Comments Comments `json:"comments,omitempty"`
 
+  // 链接中指定的SKU（如天猫链接中的skuId），
+  // 指定了SKU时价格和库存是这个SKU的，SKUs中也只有这一个
+  SKU string `json:"sku,omitempty"`
+
+  // 每个SKU（颜色、尺码等规格的组合）的价格和库存，规则中配置了sku时才有
+  SKUs []*SKU `json:"skus,omitempty"`
+
+  // 规则中声明了type的脚本的结果（如卖家、品牌、运费、优惠券、推荐商品），key是脚本名，
+  // 值的类型由脚本的type决定：string、int、float、json（原样的JSON）、urls（链接数组），
+  // 没抓到值的不会出现
+  Attributes map[string]interface{} `json:"attributes,omitempty"`
+
   // 抓取时间
   UpdateTime time.Time `json:"update_time,omitempty"`
 }
@@ -151,6 +207,19 @@ func NewProduct() *Product {
   }
 }
 
+type SKU struct {
+  ID string `json:"id"`
+
+  // 规格名称，如"红色 XL"
+  Name string `json:"name,omitempty"`
+
+  // 与Product中的取值相同，SKU不能选中（如已售完）时价格是NoValue
+  Price     float64 `json:"price,omitempty"`
+  PriceLow  float64 `json:"price_low,omitempty"`
+  PriceHigh float64 `json:"price_high,omitempty"`
+  Stock     int     `json:"stock,omitempty"`
+}
+
 type Comments struct {
   // 评论总数（对于1000+和2.7万+这类概数就算1000和27000，不会影响整体数据），
   // 0：评论总数为0（没有评论），
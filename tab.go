@@ -0,0 +1,309 @@
+package main
+
+import (
+  "io/ioutil"
+  "net/http"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/kwf2030/commons/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+// 所有抓取共用的标签页池
+var tabs *tabPool
+
+// 获取标签页的target ID（cdp中没有定义Target域）
+const getTargetInfo = "Target.getTargetInfo"
+
+// 等待Chrome关闭标签页的最长时间
+const retireTimeout = time.Second * 10
+
+// Chrome标签页池，池的大小即为最大并发抓取数，
+// 标签页在抓取完成后放回池中重复使用，不再每次抓取都创建和关闭
+type tabPool struct {
+  chrome cdp.Chrome
+
+  // 空闲的标签页，
+  // nil表示该位置的标签页还没有创建（或已经关闭），取出时再创建
+  idle chan *pooledTab
+
+  // 正在使用的标签页
+  mu   sync.Mutex
+  busy map[*cdp.Tab]*pooledTab
+
+  // 已经创建（没有关闭）的标签页数量
+  open int32
+}
+
+// 池中的标签页
+type pooledTab struct {
+  tab *cdp.Tab
+
+  // Chrome中的target ID，用于让Chrome关闭标签页
+  id string
+
+  // 空闲时丢弃事件的goroutine，关闭stop后从done得到标签页是否还可用
+  stop chan struct{}
+  done chan bool
+}
+
+func newTabPool(c cdp.Chrome, size int) *tabPool {
+  if size <= 0 {
+    size = 1
+  }
+  p := &tabPool{chrome: c, idle: make(chan *pooledTab, size), busy: make(map[*cdp.Tab]*pooledTab, size)}
+  for i := 0; i < size; i++ {
+    p.idle <- nil
+  }
+  return p
+}
+
+func (p *tabPool) size() int {
+  return cap(p.idle)
+}
+
+func (p *tabPool) opened() int {
+  return int(atomic.LoadInt32(&p.open))
+}
+
+func (p *tabPool) inUse() int {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return len(p.busy)
+}
+
+// 取出一个标签页，没有空闲的标签页时会阻塞，
+// 返回error时占用的位置已经归还，不需要再调用put
+func (p *tabPool) get() (*cdp.Tab, error) {
+  pt := <-p.idle
+  if pt != nil && !pt.wake() {
+    atomic.AddInt32(&p.open, -1)
+    pt = nil
+  }
+  if pt == nil {
+    var e error
+    pt, e = p.newTab()
+    if e != nil {
+      p.idle <- nil
+      return nil, e
+    }
+    atomic.AddInt32(&p.open, 1)
+  }
+  p.mu.Lock()
+  p.busy[pt.tab] = pt
+  p.mu.Unlock()
+  return pt.tab, nil
+}
+
+func (p *tabPool) newTab() (*pooledTab, error) {
+  t, e := p.chrome.NewTab()
+  if e != nil {
+    return nil, e
+  }
+  pt := &pooledTab{tab: t}
+  if msg := call(t, getTargetInfo, nil); msg != nil {
+    pt.id = conv.String(conv.Map(msg.Result, "targetInfo"), "targetId")
+  }
+  t.Subscribe(cdp.Page.LoadEventFired)
+  if pt.id == "" || call(t, cdp.Page.Enable, nil) == nil {
+    go pt.retire(p.chrome)
+    return nil, cdp.ErrInvalidResponse
+  }
+  return pt, nil
+}
+
+// 归还标签页，
+// broken为true表示标签页已经不可用（连接断开或超时无响应），关闭后在下次取出时重新创建
+func (p *tabPool) put(tab *cdp.Tab, broken bool) {
+  p.mu.Lock()
+  pt := p.busy[tab]
+  delete(p.busy, tab)
+  p.mu.Unlock()
+  if broken {
+    atomic.AddInt32(&p.open, -1)
+    p.idle <- nil
+    go pt.retire(p.chrome)
+    return
+  }
+  pt.sleep()
+  p.idle <- pt
+}
+
+// 让Chrome关闭所有正在使用的标签页，正在执行的调用会立即返回（标签页不可用），
+// 用于关闭Runner时不再等待还没完成的抓取
+func (p *tabPool) interrupt() {
+  p.mu.Lock()
+  ids := make([]string, 0, len(p.busy))
+  for _, pt := range p.busy {
+    ids = append(ids, pt.id)
+  }
+  p.mu.Unlock()
+  for _, id := range ids {
+    closeTarget(p.chrome, id)
+  }
+}
+
+// 等待所有标签页归还并关闭
+func (p *tabPool) close() {
+  for i := 0; i < cap(p.idle); i++ {
+    if pt := <-p.idle; pt != nil {
+      pt.wake()
+      pt.retire(p.chrome)
+      atomic.AddInt32(&p.open, -1)
+    }
+  }
+}
+
+// 放回池中后丢弃标签页上的事件和异步调用的响应，
+// 否则Tab.C的缓冲区满后cdp读取的goroutine会阻塞
+func (pt *pooledTab) sleep() {
+  stop, done := make(chan struct{}), make(chan bool, 1)
+  pt.stop, pt.done = stop, done
+  go func() {
+    for {
+      select {
+      case _, ok := <-pt.tab.C:
+        if !ok {
+          done <- false
+          return
+        }
+      case <-stop:
+        done <- true
+        return
+      }
+    }
+  }()
+}
+
+// 取出时停止丢弃，返回false表示标签页已经关闭
+func (pt *pooledTab) wake() bool {
+  close(pt.stop)
+  return <-pt.done && drain(pt.tab)
+}
+
+// 关闭标签页，不能直接调用Tab.Close：cdp读取的goroutine可能正在向Tab.C发送数据，
+// 向已关闭的channel发送会panic（没有recover，整个进程退出），
+// 所以让Chrome关闭标签页，连接断开后由cdp读取的goroutine自己调用Tab.Close，
+// 在此之前一直丢弃Tab.C中的数据，防止cdp阻塞在发送上
+func (pt *pooledTab) retire(c cdp.Chrome) {
+  if pt.id != "" {
+    closeTarget(c, pt.id)
+  }
+  timer := time.NewTimer(retireTimeout)
+  defer timer.Stop()
+  for {
+    select {
+    case _, ok := <-pt.tab.C:
+      if !ok {
+        return
+      }
+    case <-timer.C:
+      logger.Warn().Msgf("tab %s not closed by chrome", pt.id)
+      return
+    }
+  }
+}
+
+// 请求Chrome关闭标签页
+func closeTarget(c cdp.Chrome, id string) {
+  resp, e := http.Get(string(c) + "/close/" + id)
+  if e != nil {
+    logger.Error().Err(e).Msg("ERR: Close Tab")
+    return
+  }
+  ioutil.ReadAll(resp.Body)
+  resp.Body.Close()
+}
+
+// 清空标签页上次使用时残留的事件和异步调用的响应，
+// 返回false表示标签页已经关闭
+func drain(tab *cdp.Tab) bool {
+  for {
+    select {
+    case _, ok := <-tab.C:
+      if !ok {
+        return false
+      }
+    default:
+      return true
+    }
+  }
+}
+
+// 打开链接并等待页面加载完成（Page.loadEventFired），
+// 超时后不再等待，这时页面可能已经加载了大部分内容，仍然可以执行脚本，
+// 返回false表示标签页已经不可用
+func navigate(tab *cdp.Tab, addr string) bool {
+  if call(tab, cdp.Page.Navigate, cdp.Params{"url": addr}) == nil {
+    return false
+  }
+  timer := time.NewTimer(time.Second * time.Duration(Conf.Task.CrawlTimeout))
+  defer timer.Stop()
+  for {
+    select {
+    case msg, ok := <-tab.C:
+      if !ok {
+        return false
+      }
+      if msg.Method == cdp.Page.LoadEventFired {
+        return true
+      }
+    case <-timer.C:
+      logger.Debug().Msg("crawl timeout, execute expression")
+      return true
+    }
+  }
+}
+
+// 执行表达式并返回结果，第二个返回值为false表示标签页已经不可用
+func evaluate(tab *cdp.Tab, expression string) (string, bool) {
+  params := cdp.Params{"objectGroup": "console", "includeCommandLineAPI": true, "expression": expression}
+  msg := call(tab, cdp.Runtime.Evaluate, params)
+  if msg == nil {
+    return "", false
+  }
+  return conv.String(conv.Map(msg.Result, "result"), "value"), true
+}
+
+// 异步调用，返回false表示标签页已经关闭
+func callAsync(tab *cdp.Tab, method string, params cdp.Params) (ok bool) {
+  defer func() {
+    if recover() != nil {
+      ok = false
+    }
+  }()
+  tab.CallAsync(method, params)
+  return true
+}
+
+// 同步调用，标签页已经关闭或超时（两倍的crawl_timeout）无响应时返回nil，
+// 超时后标签页不再可用，由调用方归还时标记为broken
+func call(tab *cdp.Tab, method string, params cdp.Params) *cdp.Message {
+  ch := make(chan *cdp.Message, 1)
+  go func() {
+    var msg *cdp.Message
+    // 标签页的连接断开后会自动关闭，这时再调用会向已关闭的channel发送数据
+    defer func() {
+      recover()
+      ch <- msg
+    }()
+    if params == nil {
+      msg = tab.Call(method)
+    } else {
+      msg = tab.Call(method, params)
+    }
+  }()
+  if Conf.Task.CrawlTimeout <= 0 {
+    return <-ch
+  }
+  timer := time.NewTimer(time.Second * time.Duration(Conf.Task.CrawlTimeout*2))
+  defer timer.Stop()
+  select {
+  case msg := <-ch:
+    return msg
+  case <-timer.C:
+    return nil
+  }
+}